@@ -0,0 +1,279 @@
+// Copyright (c) 2026 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package core
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	mrand "math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	CHAFF_POISSON  = "poisson"
+	CHAFF_CONSTANT = "constant"
+)
+
+const DEFAULT_CHAFF_INTERVAL = 500
+const DEFAULT_CHAFF_SIZE = 1024
+const DEFAULT_CHAFF_BUDGET = 8 << 10
+
+type ChaffConfig struct {
+	// CHAFF_POISSON or CHAFF_CONSTANT.
+	Model string
+	// Mean interval between chaff frames.
+	Interval time.Duration
+	// Sizes of chaff frames are uniform in [1, MaxSize].
+	MaxSize int
+	// Bytes of chaff per second. Up to a second of budget can be saved for
+	// bursts.
+	Budget int
+}
+
+func (self *ChaffConfig) Validate() error {
+	if self.Model != CHAFF_POISSON && self.Model != CHAFF_CONSTANT {
+		return fmt.Errorf("Unknown chaff model %q, expecting %s or %s", self.Model, CHAFF_POISSON, CHAFF_CONSTANT)
+	}
+	if self.Interval <= 0 || self.MaxSize <= 0 || self.Budget <= 0 {
+		return fmt.Errorf("Interval, size and budget of chaff must be positive")
+	}
+	return nil
+}
+
+func (self *ChaffConfig) next() time.Duration {
+	if self.Model == CHAFF_POISSON {
+		return time.Duration(mrand.ExpFloat64() * float64(self.Interval))
+	}
+	return self.Interval
+}
+
+const (
+	chaffData  = 0
+	chaffDummy = 1
+)
+
+// ChaffPort marks every frame with a leading byte, so that the peer's
+// ChaffPort drops dummy frames. The mark leads so that frames can be unpacked
+// as streams. If Config is not nil, dummy frames are packed
+// at intervals in which no frame is packed.
+type ChaffPort struct {
+	Port
+	config *ChaffConfig
+	// The mark trails frames, as peers before streams expect.
+	trailing bool
+	timeout  time.Duration
+	mu       sync.Mutex
+	busy     bool
+	closed   bool
+	done     chan struct{}
+	once     sync.Once
+}
+
+func NewChaffPort(p Port, config *ChaffConfig) *ChaffPort {
+	return newChaffPort(p, config, false)
+}
+
+// NewTrailingChaffPort marks frames with a trailing byte instead, which
+// doesn't support unpacking frames as streams.
+func NewTrailingChaffPort(p Port, config *ChaffConfig) *ChaffPort {
+	return newChaffPort(p, config, true)
+}
+
+func newChaffPort(p Port, config *ChaffConfig, trailing bool) *ChaffPort {
+	self := &ChaffPort{
+		Port:     p,
+		config:   config,
+		trailing: trailing,
+		timeout:  DEFAULT_TIMEOUT * time.Second,
+		done:     make(chan struct{}),
+	}
+	if config != nil {
+		go self.run()
+	}
+	return self
+}
+
+// Marks b as data or dummy.
+func (self *ChaffPort) mark(b *IoVec, t byte) {
+	if self.trailing {
+		b.Take([]byte{t})
+	} else {
+		b.Prepend([]byte{t})
+	}
+}
+
+// Strips the mark of b.
+func (self *ChaffPort) unmark(b *IoVec) (byte, error) {
+	if !self.trailing {
+		return b.ReadByte()
+	}
+	t, err := b.LastByte()
+	if err != nil {
+		return 0, err
+	}
+	return t, b.Drop(1)
+}
+
+func (self *ChaffPort) run() {
+	tokens := float64(self.config.Budget)
+	last := time.Now()
+	timer := time.NewTimer(self.config.next())
+	defer timer.Stop()
+	for {
+		select {
+		case <-self.done:
+			return
+		case now := <-timer.C:
+			tokens = math.Min(tokens+now.Sub(last).Seconds()*float64(self.config.Budget), float64(self.config.Budget))
+			last = now
+			size := 1 + mrand.Intn(self.config.MaxSize)
+			if float64(size) <= tokens {
+				sent, err := self.chaff(size)
+				if err != nil {
+					log.Println(err)
+					return
+				}
+				if sent {
+					tokens -= float64(size)
+				}
+			}
+			timer.Reset(self.config.next())
+		}
+	}
+}
+
+// Chaff is only sent if no frame is packed since the last attempt.
+func (self *ChaffPort) chaff(size int) (bool, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.closed {
+		return false, nil
+	}
+	if self.busy {
+		self.busy = false
+		return false, nil
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return false, Tr(err)
+	}
+	b := FromSlice(buf)
+	self.mark(b, chaffDummy)
+	return true, Tr(self.Port.Pack(b))
+}
+
+func (self *ChaffPort) Pack(b *IoVec) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.closed {
+		return Tr(net.ErrClosed)
+	}
+	self.busy = true
+	self.mark(b, chaffData)
+	return Tr(self.Port.Pack(b))
+}
+
+// Since chaff keeps the underlying port from timing out, the timeout is
+// enforced here.
+func (self *ChaffPort) Unpack(b *IoVec) error {
+	start := time.Now()
+	for {
+		var v IoVec
+		if err := self.Port.Unpack(&v); err != nil {
+			return Tr(err)
+		}
+		t, err := self.unmark(&v)
+		if err != nil {
+			return Tr(fmt.Errorf("Frame is empty"))
+		}
+		switch t {
+		case chaffData:
+			b.Append(&v)
+			return nil
+		case chaffDummy:
+			if time.Since(start) > self.timeout {
+				return Tr(os.ErrDeadlineExceeded)
+			}
+		default:
+			return Tr(fmt.Errorf("Unknown frame type %d", t))
+		}
+	}
+}
+
+// Strips the mark of a frame and forwards the rest to w if it's data.
+type chaffWriter struct {
+	w    io.Writer
+	t    int
+	seen bool
+}
+
+func (self *chaffWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if !self.seen && n != 0 {
+		self.seen = true
+		self.t = int(p[0])
+		if self.t != chaffData && self.t != chaffDummy {
+			return 0, fmt.Errorf("Unknown frame type %d", self.t)
+		}
+		p = p[1:]
+	}
+	if self.t != chaffData || len(p) == 0 {
+		return n, nil
+	}
+	if _, err := self.w.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (self *ChaffPort) UnpackTo(w io.Writer) error {
+	if self.trailing {
+		var b IoVec
+		if err := self.Unpack(&b); err != nil {
+			return Tr(err)
+		}
+		_, err := b.WriteTo(w)
+		return Tr(err)
+	}
+	start := time.Now()
+	for {
+		cw := &chaffWriter{w: w}
+		if err := UnpackTo(self.Port, cw); err != nil {
+			return Tr(err)
+		}
+		if !cw.seen {
+			return Tr(fmt.Errorf("Frame is empty"))
+		}
+		if cw.t == chaffData {
+			return nil
+		}
+		if time.Since(start) > self.timeout {
+			return Tr(os.ErrDeadlineExceeded)
+		}
+	}
+}
+
+func (self *ChaffPort) stop() {
+	self.once.Do(func() { close(self.done) })
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.closed = true
+}
+
+func (self *ChaffPort) CloseWrite() error {
+	self.stop()
+	return self.Port.CloseWrite()
+}
+
+// The underlying port is closed first to unblock an in-flight Pack.
+func (self *ChaffPort) Close() error {
+	err := self.Port.Close()
+	self.stop()
+	return err
+}
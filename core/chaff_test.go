@@ -0,0 +1,169 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Frames are delivered as they are packed.
+type chanPort struct {
+	in, out chan []byte
+}
+
+func makeChanPorts() (*chanPort, *chanPort) {
+	c0, c1 := make(chan []byte, 64), make(chan []byte, 64)
+	return &chanPort{c0, c1}, &chanPort{c1, c0}
+}
+
+func (self *chanPort) Pack(b *IoVec) error {
+	self.out <- b.Consume()
+	return nil
+}
+
+func (self *chanPort) Unpack(b *IoVec) error {
+	buf, ok := <-self.in
+	if !ok {
+		return io.EOF
+	}
+	b.Take(buf)
+	return nil
+}
+
+func (self *chanPort) CloseRead() error     { return nil }
+func (self *chanPort) CloseWrite() error    { close(self.out); return nil }
+func (self *chanPort) Close() error         { return nil }
+func (self *chanPort) LocalAddr() net.Addr  { return nil }
+func (self *chanPort) RemoteAddr() net.Addr { return nil }
+
+func TestChaffPort(t *testing.T) {
+	p0, p1 := makeChanPorts()
+	config := &ChaffConfig{
+		Model:    CHAFF_CONSTANT,
+		Interval: time.Millisecond,
+		MaxSize:  64,
+		Budget:   1 << 20,
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	sender := NewChaffPort(p0, config)
+	receiver := NewChaffPort(p1, nil)
+	time.Sleep(20 * time.Millisecond)
+	if len(p1.in) == 0 {
+		t.Fatal("No chaff is sent")
+	}
+	if err := sender.Pack(FromSlice([]byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	var b IoVec
+	if err := receiver.Unpack(&b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b.Consume()) != "hello" {
+		t.Fail()
+	}
+	sender.CloseWrite()
+	for {
+		if err := receiver.Unpack(&b); err != nil {
+			if !errors.Is(err, io.EOF) {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if err := sender.Pack(FromSlice([]byte("hello"))); err == nil {
+		t.Fail()
+	}
+}
+
+func TestChaffPortBudget(t *testing.T) {
+	p0, p1 := makeChanPorts()
+	config := &ChaffConfig{
+		Model:    CHAFF_POISSON,
+		Interval: time.Millisecond,
+		MaxSize:  64,
+		Budget:   128,
+	}
+	sender := NewChaffPort(p0, config)
+	time.Sleep(50 * time.Millisecond)
+	sender.Close()
+	n := 0
+	for len(p1.in) != 0 {
+		n += len(<-p1.in) - 1
+	}
+	// A second of budget is saved at most, and 50ms earns a little more.
+	if n > 128+64 {
+		t.Fatal(n)
+	}
+}
+
+func TestChaffConfig(t *testing.T) {
+	config := &ChaffConfig{Model: "wtf", Interval: time.Second, MaxSize: 1, Budget: 1}
+	if config.Validate() == nil {
+		t.Fail()
+	}
+	config.Model = CHAFF_POISSON
+	config.Budget = 0
+	if config.Validate() == nil {
+		t.Fail()
+	}
+}
+
+func TestChaffPortUnpackTo(t *testing.T) {
+	p0, p1 := makeChanPorts()
+	config := &ChaffConfig{
+		Model:    CHAFF_CONSTANT,
+		Interval: time.Millisecond,
+		MaxSize:  64,
+		Budget:   1 << 20,
+	}
+	sender := NewChaffPort(p0, config)
+	defer sender.Close()
+	receiver := NewChaffPort(p1, nil)
+	time.Sleep(20 * time.Millisecond)
+	if err := sender.Pack(FromSlice([]byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := receiver.UnpackTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "hello" {
+		t.Fatal(b.String())
+	}
+	p0.out <- []byte{}
+	if err := receiver.UnpackTo(&b); err == nil {
+		t.Fail()
+	}
+}
+
+func TestTrailingChaffPort(t *testing.T) {
+	p0, p1 := makeChanPorts()
+	config := &ChaffConfig{
+		Model:    CHAFF_CONSTANT,
+		Interval: time.Millisecond,
+		MaxSize:  64,
+		Budget:   1 << 20,
+	}
+	sender := NewTrailingChaffPort(p0, config)
+	defer sender.Close()
+	receiver := NewTrailingChaffPort(p1, nil)
+	time.Sleep(20 * time.Millisecond)
+	if f := <-p1.in; f[len(f)-1] != chaffDummy {
+		t.Fatal(f)
+	}
+	if err := sender.Pack(FromSlice([]byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := receiver.UnpackTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "hello" {
+		t.Fatal(b.String())
+	}
+}
@@ -3,13 +3,24 @@
 package core
 
 import (
-	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
+	"sort"
 )
 
-type IoVec net.Buffers
+// IoVec is a rope of byte segments. Segments are indexed by their offsets, so
+// locating a byte is O(log n) in the number of segments. Headers and trailers
+// are attached as segments without copying bytes. Slices and read-only Views
+// share segments with the IoVec they are taken from.
+type IoVec struct {
+	segs [][]byte
+	// offs[i] is the offset of segs[i] from an origin, which moves backwards
+	// on Prepend so that offsets of other segments stay valid.
+	offs []int
+	n    int
+}
 
 func FromSlice(s []byte) *IoVec {
 	var v IoVec
@@ -17,110 +28,334 @@ func FromSlice(s []byte) *IoVec {
 	return &v
 }
 
-func (self IoVec) Len() (l int) {
-	for _, v := range self {
-		l += len(v)
-	}
-	return
+func (self *IoVec) Len() int {
+	return self.n
 }
 
-func (self IoVec) Concat() []byte {
-	var b bytes.Buffer
-	for _, s := range self {
-		b.Write(s)
-	}
-	return b.Bytes()
+// Segments returns segments of this IoVec, which must not be modified other
+// than their bytes in place.
+func (self *IoVec) Segments() [][]byte {
+	return self.segs
+}
+
+// Returns the index of the segment holding the i-th byte and where the byte
+// is in the segment.
+func (self *IoVec) locate(i int) (int, int) {
+	p := self.offs[0] + i
+	k := sort.Search(len(self.offs), func(j int) bool { return self.offs[j] > p }) - 1
+	return k, p - self.offs[k]
+}
+
+func (self *IoVec) Concat() []byte {
+	return self.AppendTo(make([]byte, 0, self.n))
 }
 
 func (self *IoVec) Take(s []byte) *IoVec {
 	if len(s) == 0 {
 		return self
 	}
-	*self = append(*self, s)
+	off := 0
+	if k := len(self.segs); k != 0 {
+		off = self.offs[k-1] + len(self.segs[k-1])
+	}
+	self.segs = append(self.segs, s)
+	self.offs = append(self.offs, off)
+	self.n += len(s)
 	return self
 }
 
-func (self *IoVec) Write(s []byte) (n int, err error) {
-	var b bytes.Buffer
-	n, err = b.Write(s)
-	if err != nil {
-		return
+// Prepend attaches s as the first segment.
+func (self *IoVec) Prepend(s []byte) *IoVec {
+	if len(s) == 0 {
+		return self
+	}
+	off := 0
+	if len(self.segs) != 0 {
+		off = self.offs[0] - len(s)
+	}
+	self.segs = append([][]byte{s}, self.segs...)
+	self.offs = append([]int{off}, self.offs...)
+	self.n += len(s)
+	return self
+}
+
+// Append takes all segments of v, which is left unchanged.
+func (self *IoVec) Append(v *IoVec) *IoVec {
+	for _, s := range v.segs {
+		self.Take(s)
 	}
-	self.Take(b.Bytes())
-	return b.Len(), nil
+	return self
+}
+
+func (self *IoVec) Write(s []byte) (n int, err error) {
+	self.Take(append([]byte(nil), s...))
+	return len(s), nil
 }
 
 func (self *IoVec) WriteTo(w io.Writer) (int64, error) {
-	return (*net.Buffers)(self).WriteTo(w)
+	// net.Buffers modifies its elements as they are written.
+	b := append(net.Buffers(nil), self.segs...)
+	n, err := b.WriteTo(w)
+	self.Skip(int(n))
+	return n, err
 }
 
 func (self *IoVec) Read(p []byte) (int, error) {
-	return (*net.Buffers)(self).Read(p)
+	if self.n == 0 {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	n := 0
+	for _, s := range self.segs {
+		if n == len(p) {
+			break
+		}
+		n += copy(p[n:], s)
+	}
+	self.Skip(n)
+	return n, nil
 }
 
-func (self *IoVec) Consume() []byte {
-	if len(*self) == 1 {
-		data := (*self)[0]
-		*self = IoVec{}
-		return data
+func (self *IoVec) ReadByte() (byte, error) {
+	if self.n == 0 {
+		return 0, io.EOF
 	}
-	b := &bytes.Buffer{}
-	_, err := b.ReadFrom(self)
-	if err != nil {
-		panic(err)
+	c := self.segs[0][0]
+	self.Skip(1)
+	return c, nil
+}
+
+// AppendTo appends all bytes of this IoVec to dst.
+func (self *IoVec) AppendTo(dst []byte) []byte {
+	for _, s := range self.segs {
+		dst = append(dst, s...)
 	}
-	return b.Bytes()
+	return dst
 }
 
-func (self IoVec) LastByte() (byte, error) {
-	l := len(self)
+// Coalesce makes this IoVec contiguous and returns its only segment. It copies
+// only if there are multiple segments.
+func (self *IoVec) Coalesce() []byte {
+	switch len(self.segs) {
+	case 0:
+		return nil
+	case 1:
+		return self.segs[0]
+	}
+	buf := self.Concat()
+	*self = IoVec{}
+	self.Take(buf)
+	return buf
+}
+
+func (self *IoVec) Consume() []byte {
+	data := self.Coalesce()
+	*self = IoVec{}
+	return data
+}
+
+func (self *IoVec) LastByte() (byte, error) {
+	l := len(self.segs)
 	if l == 0 {
 		return 0, fmt.Errorf("This IoVec is empty")
 	}
-	k := len(self[l-1])
-	return self[l-1][k-1], nil
+	k := len(self.segs[l-1])
+	return self.segs[l-1][k-1], nil
 }
 
+// Drop drops s bytes from the end.
 func (self *IoVec) Drop(s int) error {
-	l := len(*self)
-	c := 0
-	for i := l - 1; i >= 0; i-- {
-		v := (*self)[i]
-		vl := len(v)
-		if c+vl >= s {
-			(*self) = (*self)[:i]
-			self.Take(v[:c+vl-s])
+	if s < 0 || s > self.n {
+		return fmt.Errorf("Unable to drop %d bytes", s)
+	}
+	self.n -= s
+	for s > 0 {
+		k := len(self.segs) - 1
+		l := len(self.segs[k])
+		if s < l {
+			self.segs[k] = self.segs[k][: l-s : l-s]
 			return nil
 		}
-		c += vl
+		self.segs, self.offs = self.segs[:k], self.offs[:k]
+		s -= l
 	}
-	return fmt.Errorf("Unable to drop %d bytes", s)
+	return nil
 }
 
-func (self IoVec) At(i int) (byte, error) {
-	c := 0
-	for _, v := range self {
-		if i >= c && i < c+len(v) {
-			return v[i-c], nil
+// Skip drops s bytes from the beginning.
+func (self *IoVec) Skip(s int) error {
+	if s < 0 || s > self.n {
+		return fmt.Errorf("Unable to skip %d bytes", s)
+	}
+	self.n -= s
+	for s > 0 {
+		l := len(self.segs[0])
+		if s < l {
+			self.segs[0] = self.segs[0][s:]
+			self.offs[0] += s
+			return nil
 		}
-		c += len(v)
+		self.segs, self.offs = self.segs[1:], self.offs[1:]
+		s -= l
 	}
-	return 0, fmt.Errorf("Index %d out of bound", i)
+	return nil
 }
 
-func (self *IoVec) Split(i int) (tail IoVec) {
-	c := 0
-	for k, v := range *self {
-		if i >= c && i < c+len(v) {
-			tail.Take(v[i-c:])
-			if len((*self)[k+1:]) != 0 {
-				tail = append(tail, (*self)[k+1:]...)
-			}
-			*self = (*self)[:k]
-			self.Take(v[:i-c])
-			return
+func (self *IoVec) At(i int) (byte, error) {
+	if i < 0 || i >= self.n {
+		return 0, fmt.Errorf("Index %d out of bound", i)
+	}
+	k, j := self.locate(i)
+	return self.segs[k][j], nil
+}
+
+// Slice returns an IoVec of bytes in [from, to), which shares segments with
+// this IoVec, so bytes modified in place by passes run on either are modified
+// in both. It hands bytes over, e.g., before they are skipped here, use View to
+// read them. Bounds are clamped.
+func (self *IoVec) Slice(from, to int) (v IoVec) {
+	if from < 0 {
+		from = 0
+	}
+	if to > self.n {
+		to = self.n
+	}
+	if from >= to {
+		return
+	}
+	k, j := self.locate(from)
+	for rest := to - from; rest > 0; k, j = k+1, 0 {
+		s := self.segs[k][j:]
+		if len(s) > rest {
+			s = s[:rest:rest]
 		}
-		c += len(v)
+		v.Take(s)
+		rest -= len(s)
 	}
 	return
 }
+
+// View returns a read-only view of bytes in [from, to). Bounds are clamped.
+func (self *IoVec) View(from, to int) View {
+	return View{self.Slice(from, to)}
+}
+
+// View reads bytes of an IoVec without copying them, but offers no way to
+// modify them. Bytes modified in place through the IoVec are seen by the
+// view, take a copy by Concat to keep them.
+type View struct {
+	v IoVec
+}
+
+func (self View) Len() int {
+	return self.v.Len()
+}
+
+func (self View) At(i int) (byte, error) {
+	return self.v.At(i)
+}
+
+// Peek returns a copy of the first n bytes.
+func (self View) Peek(n int) ([]byte, error) {
+	if n < 0 || n > self.v.n {
+		return nil, fmt.Errorf("Unable to peek %d bytes of %d", n, self.v.n)
+	}
+	p := self.v.Slice(0, n)
+	return p.Concat(), nil
+}
+
+// WriteTo writes all bytes of the view, which is left unchanged.
+func (self View) WriteTo(w io.Writer) (int64, error) {
+	b := append(net.Buffers(nil), self.v.segs...)
+	return b.WriteTo(w)
+}
+
+func (self View) Concat() []byte {
+	return self.v.Concat()
+}
+
+// Split keeps bytes before i and returns the rest. Nothing is split if i is
+// out of bound.
+func (self *IoVec) Split(i int) (tail IoVec) {
+	if i < 0 || i >= self.n {
+		return
+	}
+	tail = self.Slice(i, self.n)
+	*self = self.Slice(0, i)
+	return
+}
+
+// Peek returns the first n bytes without consuming them. They are copied only
+// if they span segments, otherwise they alias bytes of this IoVec.
+func (self *IoVec) Peek(n int) ([]byte, error) {
+	if n < 0 || n > self.n {
+		return nil, fmt.Errorf("Unable to peek %d bytes of %d", n, self.n)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	if len(self.segs[0]) >= n {
+		return self.segs[0][:n:n], nil
+	}
+	v := self.Slice(0, n)
+	return v.Concat(), nil
+}
+
+func (self *IoVec) ReadUint16() (uint16, error) {
+	b, err := self.Peek(2)
+	if err != nil {
+		return 0, err
+	}
+	self.Skip(2)
+	return binary.BigEndian.Uint16(b), nil
+}
+
+func (self *IoVec) ReadUint32() (uint32, error) {
+	b, err := self.Peek(4)
+	if err != nil {
+		return 0, err
+	}
+	self.Skip(4)
+	return binary.BigEndian.Uint32(b), nil
+}
+
+// Nothing is consumed if the varint is malformed or truncated.
+func (self *IoVec) ReadUvarint() (uint64, error) {
+	l := binary.MaxVarintLen64
+	if l > self.n {
+		l = self.n
+	}
+	v := self.Slice(0, l)
+	x, err := binary.ReadUvarint(&v)
+	if err != nil {
+		return 0, err
+	}
+	self.Skip(l - v.Len())
+	return x, nil
+}
+
+func (self *IoVec) AppendUint16(x uint16) *IoVec {
+	return self.Take(binary.BigEndian.AppendUint16(nil, x))
+}
+
+func (self *IoVec) AppendUint32(x uint32) *IoVec {
+	return self.Take(binary.BigEndian.AppendUint32(nil, x))
+}
+
+func (self *IoVec) AppendUvarint(x uint64) *IoVec {
+	return self.Take(binary.AppendUvarint(nil, x))
+}
+
+func (self *IoVec) PrependUint16(x uint16) *IoVec {
+	return self.Prepend(binary.BigEndian.AppendUint16(nil, x))
+}
+
+func (self *IoVec) PrependUint32(x uint32) *IoVec {
+	return self.Prepend(binary.BigEndian.AppendUint32(nil, x))
+}
+
+func (self *IoVec) PrependUvarint(x uint64) *IoVec {
+	return self.Prepend(binary.AppendUvarint(nil, x))
+}
@@ -3,6 +3,7 @@
 package core
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -39,7 +40,7 @@ func TestDrop(t *testing.T) {
 	if s != "hello" {
 		t.Fail()
 	}
-	if len(v) != 0 {
+	if v.Len() != 0 {
 		t.Fail()
 	}
 }
@@ -181,3 +182,155 @@ func TestFromSlice(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestPrepend(t *testing.T) {
+	var v IoVec
+	v.Take([]byte("world"))
+	v.Prepend([]byte(", "))
+	v.Prepend([]byte("hello"))
+	for i, c := range []byte("hello, world") {
+		if b, err := v.At(i); err != nil || b != c {
+			t.Fatal(i, b, err)
+		}
+	}
+	if _, err := v.At(v.Len()); err == nil {
+		t.Fail()
+	}
+	if string(v.Consume()) != "hello, world" {
+		t.Fail()
+	}
+}
+
+func TestSlice(t *testing.T) {
+	var v IoVec
+	v.Take([]byte("hello"))
+	v.Take([]byte("foo"))
+	v.Take([]byte("bar"))
+	s := v.Slice(3, 10)
+	if string(s.Concat()) != "lofooba" {
+		t.Fail()
+	}
+	if v.Len() != 11 {
+		t.Fail()
+	}
+	// Views share bytes but not segments.
+	s.Segments()[0][0] = 'L'
+	s.Take([]byte("!"))
+	if string(v.Concat()) != "helLofoobar" {
+		t.Fail()
+	}
+	e := v.Slice(4, 4)
+	if e.Len() != 0 {
+		t.Fail()
+	}
+}
+
+func TestView(t *testing.T) {
+	var v IoVec
+	v.Take([]byte("hello"))
+	v.Take([]byte("foo"))
+	s := v.View(3, 7)
+	if s.Len() != 4 || string(s.Concat()) != "lofo" {
+		t.Fatal(string(s.Concat()))
+	}
+	if b, _ := s.At(2); b != 'f' {
+		t.Fail()
+	}
+	// Peeked bytes are copies.
+	p, err := s.Peek(2)
+	if err != nil || string(p) != "lo" {
+		t.Fatal(err)
+	}
+	p[0] = 'L'
+	if string(v.Concat()) != "hellofoo" {
+		t.Fail()
+	}
+	var buf bytes.Buffer
+	if _, err := s.WriteTo(&buf); err != nil || buf.String() != "lofo" || s.Len() != 4 {
+		t.Fatal(err, buf.String())
+	}
+	if _, err := s.Peek(5); err == nil {
+		t.Fail()
+	}
+}
+
+func TestSkip(t *testing.T) {
+	var v IoVec
+	v.Take([]byte("hello"))
+	v.Take([]byte("bar"))
+	if err := v.Skip(6); err != nil {
+		t.Fail()
+	}
+	if b, _ := v.At(0); b != 'a' {
+		t.Fail()
+	}
+	if err := v.Skip(3); err == nil {
+		t.Fail()
+	}
+	if string(v.Consume()) != "ar" {
+		t.Fail()
+	}
+}
+
+func TestPeek(t *testing.T) {
+	var v IoVec
+	v.Take([]byte("hello"))
+	v.Take([]byte("bar"))
+	p, err := v.Peek(7)
+	if err != nil || string(p) != "helloba" {
+		t.Fail()
+	}
+	if _, err := v.Peek(9); err == nil {
+		t.Fail()
+	}
+	if v.Len() != 8 {
+		t.Fail()
+	}
+}
+
+func TestIntegers(t *testing.T) {
+	var v IoVec
+	v.Take([]byte("x"))
+	v.AppendUint16(0xabcd).AppendUvarint(300).AppendUint32(0xdeadbeef)
+	v.PrependUvarint(1 << 40).PrependUint32(7).PrependUint16(9)
+	if x, err := v.ReadUint16(); err != nil || x != 9 {
+		t.Fail()
+	}
+	if x, err := v.ReadUint32(); err != nil || x != 7 {
+		t.Fail()
+	}
+	if x, err := v.ReadUvarint(); err != nil || x != 1<<40 {
+		t.Fail()
+	}
+	if c, err := v.ReadByte(); err != nil || c != 'x' {
+		t.Fail()
+	}
+	if x, err := v.ReadUint16(); err != nil || x != 0xabcd {
+		t.Fail()
+	}
+	if x, err := v.ReadUvarint(); err != nil || x != 300 {
+		t.Fail()
+	}
+	if x, err := v.ReadUint32(); err != nil || x != 0xdeadbeef {
+		t.Fail()
+	}
+	if _, err := v.ReadUint16(); err == nil {
+		t.Fail()
+	}
+}
+
+func TestReadTruncatedUvarint(t *testing.T) {
+	var v IoVec
+	v.Take([]byte{0x80})
+	v.Take([]byte{0x80})
+	if _, err := v.ReadUvarint(); err == nil {
+		t.Fail()
+	}
+	if v.Len() != 2 {
+		t.Fail()
+	}
+	v.Take([]byte{0x01})
+	if x, err := v.ReadUvarint(); err != nil || x != 1<<14 {
+		t.Fail()
+	}
+}
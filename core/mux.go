@@ -0,0 +1,470 @@
+// Copyright (c) 2026 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Every frame of a Mux starts with its type and the stream ID as an uvarint.
+//   - OPEN carries the header of the stream, e.g., the request it serves.
+//   - DATA carries bytes of the stream.
+//   - CLOSE means the sender won't send any more DATA.
+//   - RESET aborts the stream in both directions.
+//   - WINDOW carries an uvarint, bytes the receiver consumed since its last
+//     WINDOW, which the sender may send more.
+const (
+	MUX_OPEN   = 1
+	MUX_DATA   = 2
+	MUX_CLOSE  = 3
+	MUX_RESET  = 4
+	MUX_WINDOW = 5
+)
+
+// Bytes a stream may send before the peer consumes them.
+const DEFAULT_MUX_WINDOW = 256 << 10
+const MAX_MUX_DATA_SIZE = 64 << 10
+const DEFAULT_MUX_BACKLOG = 128
+
+var errStreamReset = errors.New("Stream is reset by peer")
+
+// Mux multiplexes streams over a Port, e.g., a wrapped connection between
+// relayers. Streams opened by the client have odd IDs, those opened by the
+// server have even IDs.
+type Mux struct {
+	port    Port
+	pmu     sync.Mutex
+	mu      sync.Mutex
+	next    uint64
+	streams map[uint64]*MuxStream
+	accept  chan *MuxStream
+	done    chan struct{}
+	err     error
+}
+
+func NewMux(p Port, client bool) *Mux {
+	self := &Mux{
+		port:    p,
+		next:    2,
+		streams: make(map[uint64]*MuxStream),
+		accept:  make(chan *MuxStream, DEFAULT_MUX_BACKLOG),
+		done:    make(chan struct{}),
+	}
+	if client {
+		self.next = 1
+	}
+	go self.run()
+	return self
+}
+
+func (self *Mux) send(t byte, id uint64, b *IoVec) error {
+	b.Prepend(binary.AppendUvarint([]byte{t}, id))
+	self.pmu.Lock()
+	defer self.pmu.Unlock()
+	return Tr(self.port.Pack(b))
+}
+
+func (self *Mux) sendWindow(id uint64, n int) error {
+	var b IoVec
+	b.AppendUvarint(uint64(n))
+	return self.send(MUX_WINDOW, id, &b)
+}
+
+func (self *Mux) newStream(id uint64) *MuxStream {
+	return &MuxStream{
+		mux:      self,
+		id:       id,
+		credit:   DEFAULT_MUX_WINDOW,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+		timeout:  DEFAULT_TIMEOUT * time.Second,
+	}
+}
+
+func (self *Mux) Open(hdr []byte) (*MuxStream, error) {
+	self.mu.Lock()
+	if self.err != nil {
+		defer self.mu.Unlock()
+		return nil, Tr(self.err)
+	}
+	s := self.newStream(self.next)
+	s.Header = hdr
+	self.next += 2
+	self.streams[s.id] = s
+	self.mu.Unlock()
+	if err := self.send(MUX_OPEN, s.id, FromSlice(hdr)); err != nil {
+		self.remove(s.id)
+		return nil, Tr(err)
+	}
+	return s, nil
+}
+
+// Accept returns the next stream opened by the peer.
+func (self *Mux) Accept() (*MuxStream, error) {
+	select {
+	case s := <-self.accept:
+		return s, nil
+	case <-self.done:
+		return nil, Tr(self.err)
+	}
+}
+
+func (self *Mux) NumStreams() int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return len(self.streams)
+}
+
+// Done is closed once the Mux fails or is closed, Err tells why.
+func (self *Mux) Done() <-chan struct{} {
+	return self.done
+}
+
+func (self *Mux) Err() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.err
+}
+
+func (self *Mux) Close() error {
+	err := self.port.Close()
+	self.fail(net.ErrClosed)
+	return err
+}
+
+// Fails all streams.
+func (self *Mux) fail(err error) {
+	self.mu.Lock()
+	if self.err != nil {
+		self.mu.Unlock()
+		return
+	}
+	self.err = err
+	close(self.done)
+	streams := self.streams
+	self.streams = make(map[uint64]*MuxStream)
+	self.mu.Unlock()
+	for _, s := range streams {
+		s.fail(err)
+	}
+}
+
+func (self *Mux) remove(id uint64) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.streams, id)
+}
+
+func (self *Mux) stream(id uint64) *MuxStream {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.streams[id]
+}
+
+// Frames are never packed here, since packing might block until the peer
+// reads, which might be blocked until we read.
+func (self *Mux) run() {
+	for {
+		var b IoVec
+		if err := self.port.Unpack(&b); err != nil {
+			self.port.Close()
+			self.fail(err)
+			return
+		}
+		if err := self.dispatch(&b); err != nil {
+			log.Println(err)
+			self.port.Close()
+			self.fail(err)
+			return
+		}
+	}
+}
+
+func (self *Mux) dispatch(b *IoVec) error {
+	t, err := b.ReadByte()
+	if err != nil {
+		return Tr(fmt.Errorf("Mux frame is empty"))
+	}
+	id, err := b.ReadUvarint()
+	if err != nil {
+		return Tr(err)
+	}
+	if t == MUX_OPEN {
+		return self.opened(id, b.Concat())
+	}
+	s := self.stream(id)
+	if s == nil {
+		// The stream might be closed locally.
+		return nil
+	}
+	switch t {
+	case MUX_DATA:
+		s.push(b)
+	case MUX_CLOSE:
+		s.remoteClose()
+	case MUX_RESET:
+		self.remove(id)
+		s.fail(errStreamReset)
+	case MUX_WINDOW:
+		n, err := b.ReadUvarint()
+		if err != nil {
+			return Tr(err)
+		}
+		if n > DEFAULT_MUX_WINDOW {
+			return Tr(fmt.Errorf("Window update %d of stream #%d exceeds the window", n, id))
+		}
+		s.grant(int(n))
+	default:
+		return Tr(fmt.Errorf("Unknown mux frame type %d", t))
+	}
+	return nil
+}
+
+func (self *Mux) opened(id uint64, hdr []byte) error {
+	s := self.newStream(id)
+	s.Header = hdr
+	self.mu.Lock()
+	if id%2 == self.next%2 {
+		self.mu.Unlock()
+		return Tr(fmt.Errorf("Stream #%d can't be opened by peer", id))
+	}
+	if _, in := self.streams[id]; in {
+		self.mu.Unlock()
+		return Tr(fmt.Errorf("Stream #%d already exists", id))
+	}
+	self.streams[id] = s
+	self.mu.Unlock()
+	select {
+	case self.accept <- s:
+	default:
+		log.Println("Backlog of mux is full, resetting stream", id)
+		self.remove(id)
+		go self.send(MUX_RESET, id, &IoVec{})
+	}
+	return nil
+}
+
+// MuxStream is a Port of a stream of a Mux.
+type MuxStream struct {
+	mux *Mux
+	id  uint64
+	// Sent along with OPEN.
+	Header   []byte
+	mu       sync.Mutex
+	recv     IoVec
+	readable chan struct{}
+	writable chan struct{}
+	// Bytes allowed to send.
+	credit int
+	// Bytes consumed but not reported to the peer yet.
+	consumed     int
+	localClosed  bool
+	remoteClosed bool
+	readClosed   bool
+	err          error
+	timeout      time.Duration
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (self *MuxStream) fail(err error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.err == nil {
+		self.err = err
+	}
+	signal(self.readable)
+	signal(self.writable)
+}
+
+func (self *MuxStream) push(b *IoVec) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	n := b.Len()
+	if self.readClosed {
+		// Nobody reads anymore, let the peer go on.
+		go self.mux.sendWindow(self.id, n)
+		return
+	}
+	if self.recv.Len()+n > DEFAULT_MUX_WINDOW {
+		log.Println(fmt.Errorf("Stream #%d exceeds its window", self.id))
+		self.err = errStreamReset
+		self.mux.remove(self.id)
+		go self.mux.send(MUX_RESET, self.id, &IoVec{})
+	} else {
+		self.recv.Append(b)
+	}
+	signal(self.readable)
+}
+
+func (self *MuxStream) remoteClose() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.remoteClosed = true
+	if self.localClosed {
+		self.mux.remove(self.id)
+	}
+	signal(self.readable)
+}
+
+func (self *MuxStream) grant(n int) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.credit += n
+	signal(self.writable)
+}
+
+func (self *MuxStream) wait(ch chan struct{}) error {
+	timer := time.NewTimer(self.timeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return Tr(os.ErrDeadlineExceeded)
+	}
+}
+
+// Returns bytes allowed to send, at most n.
+func (self *MuxStream) reserve(n int) (int, error) {
+	for {
+		self.mu.Lock()
+		if self.err != nil {
+			defer self.mu.Unlock()
+			return 0, Tr(self.err)
+		}
+		if self.localClosed {
+			defer self.mu.Unlock()
+			return 0, Tr(net.ErrClosed)
+		}
+		if self.credit > 0 {
+			if n > self.credit {
+				n = self.credit
+			}
+			if n > MAX_MUX_DATA_SIZE {
+				n = MAX_MUX_DATA_SIZE
+			}
+			self.credit -= n
+			self.mu.Unlock()
+			return n, nil
+		}
+		self.mu.Unlock()
+		if err := self.wait(self.writable); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Blocks while the window is exhausted. b isn't retained.
+func (self *MuxStream) Pack(b *IoVec) error {
+	for b.Len() > 0 {
+		n, err := self.reserve(b.Len())
+		if err != nil {
+			return Tr(err)
+		}
+		data := b.Slice(0, n)
+		b.Skip(n)
+		if err := self.mux.send(MUX_DATA, self.id, &data); err != nil {
+			return Tr(err)
+		}
+	}
+	return nil
+}
+
+func (self *MuxStream) Unpack(b *IoVec) error {
+	for {
+		self.mu.Lock()
+		if n := self.recv.Len(); n != 0 {
+			b.Append(&self.recv)
+			self.recv = IoVec{}
+			self.consumed += n
+			inc := 0
+			if self.consumed >= DEFAULT_MUX_WINDOW/2 {
+				inc, self.consumed = self.consumed, 0
+			}
+			self.mu.Unlock()
+			if inc != 0 {
+				return self.mux.sendWindow(self.id, inc)
+			}
+			return nil
+		}
+		if self.err != nil {
+			defer self.mu.Unlock()
+			return Tr(self.err)
+		}
+		if self.remoteClosed {
+			self.mu.Unlock()
+			return Tr(io.EOF)
+		}
+		self.mu.Unlock()
+		if err := self.wait(self.readable); err != nil {
+			return err
+		}
+	}
+}
+
+func (self *MuxStream) CloseRead() error {
+	self.mu.Lock()
+	self.readClosed = true
+	n := self.recv.Len()
+	self.recv = IoVec{}
+	self.mu.Unlock()
+	if n != 0 {
+		return self.mux.sendWindow(self.id, n)
+	}
+	return nil
+}
+
+func (self *MuxStream) CloseWrite() error {
+	self.mu.Lock()
+	if self.localClosed || self.err != nil {
+		self.mu.Unlock()
+		return nil
+	}
+	self.localClosed = true
+	if self.remoteClosed {
+		self.mux.remove(self.id)
+	}
+	self.mu.Unlock()
+	signal(self.writable)
+	return self.mux.send(MUX_CLOSE, self.id, &IoVec{})
+}
+
+// The stream is reset unless both ends closed it.
+func (self *MuxStream) Close() error {
+	self.mu.Lock()
+	reset := self.err == nil && !(self.localClosed && self.remoteClosed)
+	if self.err == nil {
+		self.err = net.ErrClosed
+	}
+	self.recv = IoVec{}
+	self.mu.Unlock()
+	signal(self.readable)
+	signal(self.writable)
+	self.mux.remove(self.id)
+	if reset {
+		return self.mux.send(MUX_RESET, self.id, &IoVec{})
+	}
+	return nil
+}
+
+func (self *MuxStream) LocalAddr() net.Addr {
+	return self.mux.port.LocalAddr()
+}
+
+func (self *MuxStream) RemoteAddr() net.Addr {
+	return self.mux.port.RemoteAddr()
+}
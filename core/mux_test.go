@@ -0,0 +1,154 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func makeMuxes() (*Mux, *Mux) {
+	p0, p1 := makeChanPorts()
+	return NewMux(p0, true), NewMux(p1, false)
+}
+
+func readAll(t *testing.T, p Port, n int) []byte {
+	var r []byte
+	for len(r) < n {
+		var b IoVec
+		if err := p.Unpack(&b); err != nil {
+			t.Fatal(err)
+		}
+		r = append(r, b.Consume()...)
+	}
+	return r
+}
+
+func TestMux(t *testing.T) {
+	client, server := makeMuxes()
+	defer client.Close()
+	defer server.Close()
+	var streams [2]*MuxStream
+	for i, addr := range []string{"example.com:80", "example.com:443"} {
+		s, err := client.Open([]byte(addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams[i] = s
+	}
+	for i := range streams {
+		s, err := server.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(s.Header, streams[i].Header) {
+			t.Fatal(string(s.Header))
+		}
+		msg := append([]byte(nil), s.Header...)
+		if err := streams[i].Pack(FromSlice(msg)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(readAll(t, s, len(msg)), msg) {
+			t.Fail()
+		}
+		if err := s.Pack(FromSlice([]byte("reply"))); err != nil {
+			t.Fatal(err)
+		}
+		if string(readAll(t, streams[i], 5)) != "reply" {
+			t.Fail()
+		}
+		streams[i].CloseWrite()
+		var b IoVec
+		if err := s.Unpack(&b); !errors.Is(err, io.EOF) {
+			t.Fatal(err)
+		}
+		s.CloseWrite()
+		if err := streams[i].Unpack(&b); !errors.Is(err, io.EOF) {
+			t.Fatal(err)
+		}
+		streams[i].Close()
+		s.Close()
+	}
+	if client.NumStreams() != 0 || server.NumStreams() != 0 {
+		t.Fatal(client.NumStreams(), server.NumStreams())
+	}
+}
+
+func TestMuxFlowControl(t *testing.T) {
+	client, server := makeMuxes()
+	defer client.Close()
+	defer server.Close()
+	c, err := client.Open([]byte("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 3*DEFAULT_MUX_WINDOW)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	done := make(chan error)
+	go func() {
+		done <- c.Pack(FromSlice(append([]byte(nil), data...)))
+	}()
+	select {
+	case <-done:
+		t.Fatal("Window is not respected")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if !bytes.Equal(readAll(t, s, len(data)), data) {
+		t.Fatal("Data is corrupted")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxReset(t *testing.T) {
+	client, server := makeMuxes()
+	defer client.Close()
+	defer server.Close()
+	c, err := client.Open([]byte("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	var b IoVec
+	if err := c.Unpack(&b); !errors.Is(err, errStreamReset) {
+		t.Fatal(err)
+	}
+	if err := c.Pack(FromSlice([]byte("hello"))); err == nil {
+		t.Fail()
+	}
+}
+
+func TestMuxPortFailure(t *testing.T) {
+	p0, p1 := makeChanPorts()
+	client := NewMux(p0, true)
+	server := NewMux(p1, false)
+	defer client.Close()
+	c, err := client.Open([]byte("example.com:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	p1.CloseWrite()
+	var b IoVec
+	if err := c.Unpack(&b); !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	<-client.Done()
+	if _, err := client.Open([]byte("example.com:80")); err == nil {
+		t.Fail()
+	}
+}
@@ -10,6 +10,49 @@ type Pass interface {
 	Run(*IoVec) error
 }
 
+// Passes work on segments of a frame wherever they can, e.g., transforming
+// segments in place or appending headers and trailers as new segments, so
+// that a frame is copied at most once through a pipeline. Passes which can't
+// declare so by implementing ContiguousPass or SegmentPass. PassManager runs
+// them by RunContiguous or RunSegments respectively, i.e., it coalesces a
+// frame only before a ContiguousPass. Their Run should do the same for use
+// outside of PassManager.
+
+// ContiguousPass needs a frame in one segment. The returned buffer replaces
+// the frame.
+type ContiguousPass interface {
+	Pass
+	RunContiguous(buf []byte) ([]byte, error)
+}
+
+// Frames are coalesced only if they are not contiguous yet.
+func RunContiguous(p ContiguousPass, b *IoVec) error {
+	buf, err := p.RunContiguous(b.Coalesce())
+	if err != nil {
+		return err
+	}
+	*b = IoVec{}
+	b.Take(buf)
+	return nil
+}
+
+// SegmentPass transforms every byte of a frame in place independent of
+// segmentation, e.g., XOR with a key stream. offset is where seg is in the
+// frame.
+type SegmentPass interface {
+	Pass
+	RunSegment(offset int, seg []byte)
+}
+
+func RunSegments(p SegmentPass, b *IoVec) error {
+	offset := 0
+	for _, s := range b.Segments() {
+		p.RunSegment(offset, s)
+		offset += len(s)
+	}
+	return nil
+}
+
 type PassManager struct {
 	passes []Pass
 }
@@ -21,7 +64,14 @@ func (self *PassManager) AddPass(p Pass) *PassManager {
 
 func (self *PassManager) Run(b *IoVec) (err error) {
 	for _, p := range self.passes {
-		err = p.Run(b)
+		switch p := p.(type) {
+		case ContiguousPass:
+			err = RunContiguous(p, b)
+		case SegmentPass:
+			err = RunSegments(p, b)
+		default:
+			err = p.Run(b)
+		}
 		if err != nil {
 			return
 		}
@@ -0,0 +1,51 @@
+package core
+
+import (
+	"errors"
+	"testing"
+)
+
+// Run must not be called by PassManager.
+type reversePass struct {
+	contiguous bool
+}
+
+func (self *reversePass) Run(b *IoVec) error {
+	return errors.New("Run is called")
+}
+
+func (self *reversePass) RunContiguous(buf []byte) ([]byte, error) {
+	self.contiguous = true
+	for i, j := 0, len(buf)-1; i < j; i, j = i+1, j-1 {
+		buf[i], buf[j] = buf[j], buf[i]
+	}
+	return buf, nil
+}
+
+type xorPass struct{}
+
+func (self *xorPass) Run(b *IoVec) error {
+	return errors.New("Run is called")
+}
+
+func (self *xorPass) RunSegment(offset int, seg []byte) {
+	for i := range seg {
+		seg[i] ^= byte(offset + i)
+	}
+}
+
+func TestPassManagerRun(t *testing.T) {
+	rev := &reversePass{}
+	pm := NewPassManager([]Pass{&xorPass{}, rev})
+	var b IoVec
+	b.Take([]byte{0, 1}).Take([]byte{2, 3})
+	if err := pm.Run(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !rev.contiguous || len(b.Segments()) != 1 {
+		t.Fatal(b.Segments())
+	}
+	if s := b.Consume(); string(s) != string([]byte{0, 0, 0, 0}) {
+		t.Fatal(s)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2026 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package core
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Buffers are pooled in size classes of powers of 2, from
+// MIN_POOLED_BUFFER_SIZE to MAX_POOLED_BUFFER_SIZE. Larger buffers are left to
+// the garbage collector.
+const MIN_POOLED_BUFFER_SIZE = DEFAULT_UDP_BUFFER_SIZE
+const MAX_POOLED_BUFFER_SIZE = 4 << 20
+
+// log2(MAX_POOLED_BUFFER_SIZE / MIN_POOLED_BUFFER_SIZE) + 1
+const bufferClasses = 12
+
+var bufferPools [bufferClasses]sync.Pool
+
+// Returns the smallest class holding size bytes, or -1 if none does.
+func bufferClass(size int) int {
+	if size <= MIN_POOLED_BUFFER_SIZE {
+		return 0
+	}
+	if size > MAX_POOLED_BUFFER_SIZE {
+		return -1
+	}
+	return bits.Len(uint((size - 1) / MIN_POOLED_BUFFER_SIZE))
+}
+
+func classSize(class int) int {
+	return MIN_POOLED_BUFFER_SIZE << class
+}
+
+// GetBuffer returns a buffer of size bytes, whose capacity is its class size.
+func GetBuffer(size int) []byte {
+	c := bufferClass(size)
+	if c < 0 {
+		return make([]byte, size)
+	}
+	if p, ok := bufferPools[c].Get().(*[]byte); ok {
+		return (*p)[:size]
+	}
+	return make([]byte, size, classSize(c))
+}
+
+// PutBuffer recycles a buffer from GetBuffer. b must not be referenced
+// anymore.
+func PutBuffer(b []byte) {
+	c := bufferClass(cap(b))
+	if c < 0 || classSize(c) != cap(b) {
+		return
+	}
+	b = b[:cap(b)]
+	bufferPools[c].Put(&b)
+}
+
+// Recycler is implemented by ports whose unpacked frames are backed by pooled
+// buffers. Recycle releases the buffer of the last unpacked frame, so it must
+// be called only after the frame is no longer referenced, e.g., Pack of
+// another port returned. Ports must not retain frames after Pack returns.
+type Recycler interface {
+	Recycle()
+}
@@ -0,0 +1,116 @@
+package core
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestBufferClass(t *testing.T) {
+	for _, c := range []struct{ size, class int }{
+		{0, 0},
+		{1, 0},
+		{MIN_POOLED_BUFFER_SIZE, 0},
+		{MIN_POOLED_BUFFER_SIZE + 1, 1},
+		{MIN_POOLED_BUFFER_SIZE * 2, 1},
+		{MIN_POOLED_BUFFER_SIZE*2 + 1, 2},
+		{MAX_POOLED_BUFFER_SIZE, bufferClasses - 1},
+		{MAX_POOLED_BUFFER_SIZE + 1, -1},
+	} {
+		if bufferClass(c.size) != c.class {
+			t.Errorf("Size %d is expected in class %d, got %d", c.size, c.class, bufferClass(c.size))
+		}
+	}
+	if classSize(bufferClasses-1) != MAX_POOLED_BUFFER_SIZE {
+		t.Fail()
+	}
+}
+
+func TestGetBuffer(t *testing.T) {
+	b := GetBuffer(3000)
+	if len(b) != 3000 || cap(b) != MIN_POOLED_BUFFER_SIZE*2 {
+		t.Fatal(len(b), cap(b))
+	}
+	PutBuffer(b)
+	b = GetBuffer(MAX_POOLED_BUFFER_SIZE + 1)
+	if len(b) != MAX_POOLED_BUFFER_SIZE+1 {
+		t.Fatal(len(b))
+	}
+	// Not pooled.
+	PutBuffer(b)
+	PutBuffer(make([]byte, 3000))
+}
+
+func TestRawNetPortAdapt(t *testing.T) {
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+	p := NewRawNetPort(c1)
+	class := p.class
+	go func() {
+		c0.Write(make([]byte, DEFAULT_RAW_BUFFER_SIZE))
+		c0.Write([]byte("hello"))
+	}()
+	var b IoVec
+	if err := p.Unpack(&b); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != DEFAULT_RAW_BUFFER_SIZE || p.class != class+1 {
+		t.Fatal(b.Len(), p.class)
+	}
+	p.Recycle()
+	b = IoVec{}
+	if err := p.Unpack(&b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b.Consume()) != "hello" || p.class != class {
+		t.Fatal(p.class)
+	}
+	p.Recycle()
+	if p.buf != nil {
+		t.Fail()
+	}
+}
+
+// Frames of thousands of concurrent sessions are unpacked and recycled.
+func BenchmarkRawNetPortSessions(b *testing.B) {
+	const sessions = 2000
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	frame := make([]byte, 4<<10)
+	b.SetBytes(int64(len(frame)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for i := 0; i < sessions; i++ {
+		n := b.N / sessions
+		if i < b.N%sessions {
+			n++
+		}
+		c0, c1 := net.Pipe()
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			defer c0.Close()
+			for k := 0; k < n; k++ {
+				c0.Write(frame)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			defer c1.Close()
+			p := NewRawNetPort(c1)
+			for {
+				var v IoVec
+				if err := p.Unpack(&v); err != nil {
+					return
+				}
+				p.Recycle()
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -3,6 +3,7 @@
 package core
 
 import (
+	"crypto/tls"
 	"errors"
 	"io"
 	"log"
@@ -13,6 +14,7 @@ import (
 
 const DEFAULT_TIMEOUT = 60 * 60
 const DEFAULT_BUFFER_SIZE = 256 << 10
+const DEFAULT_RAW_BUFFER_SIZE = 16 << 10
 const DEFAULT_BUFFER_LIMIT = 64 << 20
 const DEFAULT_UDP_TIMEOUT = 60
 const DEFAULT_UDP_BUFFER_SIZE = 2 << 10
@@ -21,6 +23,11 @@ type PortBuilder interface {
 	FromConn(net.Conn) Port
 }
 
+// Dialer is satisfied by *net.Dialer.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
 func CloseRead(c net.Conn) error {
 	if c, ok := c.(*net.TCPConn); ok {
 		return c.CloseRead()
@@ -38,6 +45,9 @@ func CloseWrite(c net.Conn) error {
 	if c, ok := c.(*net.UnixConn); ok {
 		return c.CloseWrite()
 	}
+	if c, ok := c.(*tls.Conn); ok {
+		return c.CloseWrite()
+	}
 	return nil
 }
 
@@ -114,17 +124,21 @@ func (self *NetPort) RemoteAddr() net.Addr {
 	return self.conn.RemoteAddr()
 }
 
+// RawNetPort reads into pooled buffers, whose class adapts to sizes of
+// recent reads, so idle connections hold small buffers.
 type RawNetPort struct {
 	conn    net.Conn
 	timeout time.Duration
-	buf     []byte
-	nr      int
+	class   int
+	// Backs the last unpacked frame until it's recycled.
+	buf []byte
 }
 
 func NewRawNetPortWithTimeout(c net.Conn, timeout int) *RawNetPort {
 	return &RawNetPort{
 		conn:    c,
 		timeout: time.Duration(timeout) * time.Second,
+		class:   bufferClass(DEFAULT_RAW_BUFFER_SIZE),
 	}
 }
 
@@ -140,49 +154,44 @@ func (self *RawNetPort) Pack(b *IoVec) error {
 	return Tr(err)
 }
 
-func (self *RawNetPort) growBuffer() {
-	l := len(self.buf)
-	nl := l
-	if nl <= self.nr {
-		if self.nr == 0 {
-			// If DEFAULT_BUFFER_SIZE is too small, times of buffer allocation will increase and thus hurt performance.
-			nl = DEFAULT_BUFFER_SIZE
-		} else {
-			nl = self.nr * 2
-		}
-	}
-	// Ensure we have sufficient buffer for UDP transfer.
-	if nl < DEFAULT_UDP_BUFFER_SIZE {
-		nl = DEFAULT_UDP_BUFFER_SIZE
+// Grows the class if the buffer was filled and shrinks it if less than a
+// quarter was used.
+func (self *RawNetPort) adapt(n, l int) {
+	if n == l && classSize(self.class+1) <= MAX_POOLED_BUFFER_SIZE {
+		self.class++
+	} else if n < l/4 && self.class > 0 {
+		self.class--
 	}
-	if nl > DEFAULT_BUFFER_LIMIT {
-		nl = DEFAULT_BUFFER_LIMIT
-	}
-	if nl <= l {
-		return
-	}
-	self.buf = make([]byte, nl)
 }
 
 func (self *RawNetPort) Unpack(b *IoVec) (err error) {
-	self.growBuffer()
 	err = self.conn.SetReadDeadline(time.Now().Add(self.timeout))
 	if err != nil {
 		return Tr(err)
 	}
-	self.nr, err = self.conn.Read(self.buf)
+	buf := GetBuffer(classSize(self.class))
+	n, err := self.conn.Read(buf)
 	if err != nil {
+		PutBuffer(buf)
 		if errors.Is(err, io.EOF) {
 			log.Println(self.conn.RemoteAddr(), "->", self.conn.LocalAddr(), "is closed")
 		}
-		self.nr = 0
 		return Tr(err)
 	}
-	b.Take(self.buf[:self.nr])
-	self.buf = self.buf[self.nr:]
+	self.adapt(n, len(buf))
+	// The last frame might be still referenced if it's not recycled.
+	self.buf = buf
+	b.Take(buf[:n])
 	return nil
 }
 
+func (self *RawNetPort) Recycle() {
+	if self.buf != nil {
+		PutBuffer(self.buf)
+		self.buf = nil
+	}
+}
+
 func (self *RawNetPort) CloseRead() error {
 	return CloseRead(self.conn)
 }
@@ -3,7 +3,12 @@
 package core
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"os"
+	"syscall"
 )
 
 type Relayer struct {
@@ -15,9 +20,85 @@ func NewRelayer(fe Frontend, be Backend) *Relayer {
 	return &Relayer{fe, be}
 }
 
+// Networks of relayed ports. Frames of NETWORK_UDP ports carry datagrams
+// along with their addresses, rather than a byte stream. NETWORK_BIND ports
+// accept a connection from addr on behalf of the client, the stream starts
+// with SOCKS5 replies of the listening address and the accepted peer.
+const (
+	NETWORK_TCP  = "tcp"
+	NETWORK_UDP  = "udp"
+	NETWORK_BIND = "bind"
+)
+
+// Returned by backends for networks they don't relay.
+var ErrUnsupportedNetwork = errors.New("Network is not supported")
+
+// Classes of dial errors, telling frontends why the destination wasn't
+// dialed.
+const (
+	DIAL_ERROR_OTHER = iota
+	DIAL_ERROR_REFUSED
+	DIAL_ERROR_NETWORK_UNREACHABLE
+	DIAL_ERROR_HOST_UNREACHABLE
+	DIAL_ERROR_TIMEOUT
+	DIAL_ERROR_UNSUPPORTED_NETWORK
+)
+
+// DialError is returned by backends if the destination failed to be dialed.
+// Other errors of dialing, e.g., of broken tunnels, tell nothing about the
+// destination.
+type DialError struct {
+	Addr  string
+	Class int
+	Err   error
+}
+
+func NewDialError(addr string, err error) *DialError {
+	return &DialError{Addr: addr, Class: ClassifyDialError(err), Err: err}
+}
+
+func (self *DialError) Error() string {
+	return fmt.Sprintf("Failed to dial %s: %v", self.Addr, self.Err)
+}
+
+func (self *DialError) Unwrap() error {
+	return self.Err
+}
+
+// ClassifyDialError returns the class of err, which is the class of the
+// DialError it wraps if any.
+func ClassifyDialError(err error) int {
+	var de *DialError
+	var ne net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &de):
+		return de.Class
+	case errors.Is(err, ErrUnsupportedNetwork):
+		return DIAL_ERROR_UNSUPPORTED_NETWORK
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return DIAL_ERROR_REFUSED
+	case errors.Is(err, syscall.ENETUNREACH):
+		return DIAL_ERROR_NETWORK_UNREACHABLE
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return DIAL_ERROR_HOST_UNREACHABLE
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return DIAL_ERROR_TIMEOUT
+	}
+	return DIAL_ERROR_OTHER
+}
+
 type AcceptResult struct {
 	Port
 	Addr string
+	// Empty means NETWORK_TCP.
+	Network string
+	// The user authenticated by the frontend, if any.
+	User string
+	// If not nil, it's called once dialing resolves and before traffic is
+	// relayed, e.g., to reply the client. bound is the address the backend
+	// dialed from, if known. Nothing is relayed if it returns an error.
+	Reply func(bound net.Addr, err error) error
 }
 
 type Frontend interface {
@@ -26,10 +107,47 @@ type Frontend interface {
 
 type DialResult struct {
 	Port
+	// The local address of the connection to the destination, if known.
+	Bound net.Addr
+	// Set if dialing failed, Port is nil then.
+	Err error
 }
 
+// The channel returned by Dial receives one DialResult, or is closed if the
+// backend can't tell why dialing failed.
 type Backend interface {
-	Dial(addr string) chan DialResult
+	Dial(network, addr string) chan DialResult
+}
+
+// Handle relays a port accepted by the frontend, it returns once relaying is
+// done.
+func (self *Relayer) Handle(ar AcceptResult) {
+	defer ar.Port.Close()
+	dr, ok := <-self.be.Dial(ar.Network, ar.Addr)
+	if !ok {
+		dr.Err = fmt.Errorf("Dialing %s failed", ar.Addr)
+	}
+	if dr.Port != nil {
+		defer dr.Port.Close()
+	}
+	if ar.Reply != nil {
+		if err := ar.Reply(dr.Bound, dr.Err); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	if dr.Err != nil {
+		log.Println(dr.Err)
+		return
+	}
+	if ar.User != "" {
+		log.Println("Relaying for user", ar.User)
+	}
+	log.Println("Relaying",
+		ar.Port.RemoteAddr(), "<->", ar.Port.LocalAddr(),
+		"<->",
+		dr.Port.LocalAddr(), "<->", dr.Port.RemoteAddr())
+	RunSimpleSwitch(ar.Port, dr.Port)
 }
 
 func (self *Relayer) Relay() error {
@@ -40,17 +158,7 @@ func (self *Relayer) Relay() error {
 			if !ok {
 				return
 			}
-			defer ar.Port.Close()
-			dr, ok := <-self.be.Dial(ar.Addr)
-			if !ok {
-				return
-			}
-			defer dr.Port.Close()
-			log.Println("Relaying",
-				ar.Port.RemoteAddr(), "<->", ar.Port.LocalAddr(),
-				"<->",
-				dr.Port.LocalAddr(), "<->", dr.Port.RemoteAddr())
-			RunSimpleSwitch(ar.Port, dr.Port)
+			self.Handle(ar)
 		}(c)
 	}
 	return nil
@@ -5,6 +5,8 @@ package core
 import (
 	"fmt"
 	"log"
+	"net"
+	"sync"
 )
 
 type RouteId uint64
@@ -14,9 +16,18 @@ type Codec interface {
 	Decode(*IoVec) (RouteId, error)
 }
 
+// Frames decoded for a route wait in its queue. Once the queue is full, the
+// router stops unpacking the shared port until the route catches up.
+const DEFAULT_ROUTE_QUEUE_SIZE = 64
+
 type RouteInfo struct {
-	P   *SyncPort
-	Err chan error
+	P *SyncPort
+	// Receives the error the route is closed for, e.g., net.ErrClosed if it's
+	// closed by CloseRoute. It's buffered, so it needn't be read.
+	Err   chan error
+	queue chan IoVec
+	done  chan struct{}
+	once  sync.Once
 }
 
 type SimpleRouter struct {
@@ -25,44 +36,82 @@ type SimpleRouter struct {
 	routes Map[RouteId, *RouteInfo]
 }
 
+// Frames of the route are packed in order of decoding.
+func (self *SimpleRouter) deliver(id RouteId, ri *RouteInfo) {
+	for {
+		select {
+		case b := <-ri.queue:
+			if err := ri.P.Pack(&b); err != nil {
+				self.closeRoute(id, ri, err)
+				return
+			}
+		case <-ri.done:
+			return
+		}
+	}
+}
+
 func (self *SimpleRouter) route(id RouteId, ri *RouteInfo) {
 	for {
 		var b IoVec
 		err := ri.P.Unpack(&b)
 		if err != nil {
-			ri.Err <- err
+			self.closeRoute(id, ri, err)
 			return
 		}
 		err = self.C.Encode(id, &b)
 		if err != nil {
-			ri.Err <- err
+			self.closeRoute(id, ri, err)
 			return
 		}
 		if err = self.P.Pack(&b); err != nil {
-			ri.Err <- err
+			self.closeRoute(id, ri, err)
 			return
 		}
 	}
 }
 
+// Closing the port of the route stops its goroutines. The entry is deleted
+// only if it's still ri, so a new route of the same ID is left alone.
+func (self *SimpleRouter) closeRoute(id RouteId, ri *RouteInfo, err error) {
+	ri.once.Do(func() {
+		self.routes.CompareAndDelete(id, ri)
+		close(ri.done)
+		ri.P.Close()
+		ri.Err <- err
+	})
+}
+
 func (self *SimpleRouter) NewRoute(id RouteId, P *SyncPort) (*RouteInfo, error) {
-	ri := &RouteInfo{P: P, Err: make(chan error)}
+	ri := &RouteInfo{
+		P:     P,
+		Err:   make(chan error, 1),
+		queue: make(chan IoVec, DEFAULT_ROUTE_QUEUE_SIZE),
+		done:  make(chan struct{}),
+	}
 	if v, in := self.routes.LoadOrStore(id, ri); in {
 		return v, fmt.Errorf("Route #%d already exists", id)
 	}
-	go func() {
-		defer self.routes.Delete(id)
-		self.route(id, ri)
-	}()
+	go self.route(id, ri)
+	go self.deliver(id, ri)
 	return ri, nil
 }
 
-func (self *SimpleRouter) Run() {
+// CloseRoute closes the route and its port.
+func (self *SimpleRouter) CloseRoute(id RouteId) error {
+	ri, in := self.routes.Load(id)
+	if !in {
+		return fmt.Errorf("Route #%d doesn't exist", id)
+	}
+	self.closeRoute(id, ri, net.ErrClosed)
+	return nil
+}
+
+func (self *SimpleRouter) dispatch() error {
 	for {
 		var b IoVec
-		err := self.P.Unpack(&b)
-		if err != nil {
-			return
+		if err := self.P.Unpack(&b); err != nil {
+			return err
 		}
 		id, err := self.C.Decode(&b)
 		if err != nil {
@@ -73,11 +122,18 @@ func (self *SimpleRouter) Run() {
 			log.Println(fmt.Errorf("Route #%d doesn't exist", id))
 			continue
 		}
-		go func(ri *RouteInfo) {
-			if err := ri.P.Pack(&b); err != nil {
-				ri.Err <- err
-				return
-			}
-		}(ri)
+		select {
+		case ri.queue <- b:
+		case <-ri.done:
+		}
 	}
 }
+
+// Run returns once the shared port fails, closing all routes.
+func (self *SimpleRouter) Run() {
+	err := self.dispatch()
+	self.routes.Range(func(id RouteId, ri *RouteInfo) bool {
+		self.closeRoute(id, ri, err)
+		return true
+	})
+}
@@ -0,0 +1,157 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type idCodec struct{}
+
+func (idCodec) Encode(id RouteId, b *IoVec) error {
+	b.PrependUvarint(uint64(id))
+	return nil
+}
+
+func (idCodec) Decode(b *IoVec) (RouteId, error) {
+	id, err := b.ReadUvarint()
+	return RouteId(id), err
+}
+
+// Pack blocks until the gate is opened.
+type gatedPort struct {
+	chanPort
+	gate   chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newGatedPort() *gatedPort {
+	return &gatedPort{
+		chanPort: chanPort{make(chan []byte), make(chan []byte, 1024)},
+		gate:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (self *gatedPort) Pack(b *IoVec) error {
+	select {
+	case <-self.gate:
+	case <-self.closed:
+		return net.ErrClosed
+	}
+	return self.chanPort.Pack(b)
+}
+
+func (self *gatedPort) Unpack(b *IoVec) error {
+	<-self.closed
+	return net.ErrClosed
+}
+
+func (self *gatedPort) Close() error {
+	self.once.Do(func() { close(self.closed) })
+	return nil
+}
+
+func newTestRouter() (*SimpleRouter, *chanPort) {
+	in, out := make(chan []byte, 1024), make(chan []byte, 1024)
+	r := &SimpleRouter{
+		P: AsSyncPort(&chanPort{in, out}, &sync.Mutex{}, &sync.Mutex{}),
+		C: idCodec{},
+	}
+	return r, &chanPort{out, in}
+}
+
+func sendRouted(t *testing.T, p Port, id RouteId, s string) {
+	b := FromSlice([]byte(s))
+	b.PrependUvarint(uint64(id))
+	if err := p.Pack(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRouterOrder(t *testing.T) {
+	r, peer := newTestRouter()
+	go r.Run()
+	rp := newGatedPort()
+	close(rp.gate)
+	if _, err := r.NewRoute(1, AsSyncPort(rp, &sync.Mutex{}, &sync.Mutex{})); err != nil {
+		t.Fatal(err)
+	}
+	const n = 500
+	for i := 0; i < n; i++ {
+		sendRouted(t, peer, 1, fmt.Sprint(i))
+	}
+	for i := 0; i < n; i++ {
+		if s := string(<-rp.out); s != fmt.Sprint(i) {
+			t.Fatal("Expecting frame", i, "got", s)
+		}
+	}
+	peer.CloseWrite()
+}
+
+func TestRouterBackpressure(t *testing.T) {
+	r, peer := newTestRouter()
+	go r.Run()
+	rp := newGatedPort()
+	if _, err := r.NewRoute(1, AsSyncPort(rp, &sync.Mutex{}, &sync.Mutex{})); err != nil {
+		t.Fatal(err)
+	}
+	const n = 2 * DEFAULT_ROUTE_QUEUE_SIZE
+	for i := 0; i < n; i++ {
+		sendRouted(t, peer, 1, fmt.Sprint(i))
+	}
+	time.Sleep(20 * time.Millisecond)
+	// The route holds a frame being packed, a queue of frames and the frame
+	// Run is blocked on.
+	if l := len(peer.out); l != n-DEFAULT_ROUTE_QUEUE_SIZE-2 {
+		t.Fatal(l, "frames are not unpacked")
+	}
+	close(rp.gate)
+	for i := 0; i < n; i++ {
+		if s := string(<-rp.out); s != fmt.Sprint(i) {
+			t.Fatal("Expecting frame", i, "got", s)
+		}
+	}
+	peer.CloseWrite()
+}
+
+func TestRouterCloseRoute(t *testing.T) {
+	r, peer := newTestRouter()
+	go r.Run()
+	rp := newGatedPort()
+	ri, err := r.NewRoute(1, AsSyncPort(rp, &sync.Mutex{}, &sync.Mutex{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.NewRoute(1, AsSyncPort(rp, &sync.Mutex{}, &sync.Mutex{})); err == nil {
+		t.Fail()
+	}
+	if err := r.CloseRoute(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-ri.Err; !errors.Is(err, net.ErrClosed) {
+		t.Fatal(err)
+	}
+	<-rp.closed
+	if err := r.CloseRoute(1); err == nil {
+		t.Fail()
+	}
+	rp2 := newGatedPort()
+	ri2, err := r.NewRoute(1, AsSyncPort(rp2, &sync.Mutex{}, &sync.Mutex{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Closing the shared port tears down all routes.
+	peer.CloseWrite()
+	if err := <-ri2.Err; err == nil {
+		t.Fail()
+	}
+	<-rp2.closed
+	if r.routes.Size() != 0 {
+		t.Fail()
+	}
+}
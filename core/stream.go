@@ -0,0 +1,130 @@
+// Copyright (c) 2026 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package core
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// StreamPass transforms a frame as a stream, reading from r and writing to w,
+// so the frame is never held as a whole. Encoders read the frame from r and
+// write to the connection, decoders read one frame from the connection and
+// write it to w as it arrives.
+type StreamPass interface {
+	RunStream(w io.Writer, r io.Reader) error
+}
+
+// StreamPort can unpack a frame as a stream. Bytes of the frame are written
+// to w as they arrive, w must not retain them after Write returns.
+type StreamPort interface {
+	Port
+	UnpackTo(w io.Writer) error
+}
+
+// UnpackTo unpacks a frame of p to w, as a stream if p is a StreamPort.
+// Otherwise the frame is unpacked as a whole and written by one Write.
+func UnpackTo(p Port, w io.Writer) error {
+	if sp, ok := p.(StreamPort); ok {
+		return sp.UnpackTo(w)
+	}
+	var b IoVec
+	if err := p.Unpack(&b); err != nil {
+		return Tr(err)
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	_, err := w.Write(b.Coalesce())
+	return Tr(err)
+}
+
+// PortWriter packs every Write as a frame. The first error of Pack is kept in
+// Err, so it can be told apart from errors of the other end.
+type PortWriter struct {
+	Port
+	Err error
+}
+
+func (self *PortWriter) Write(p []byte) (int, error) {
+	if self.Err != nil {
+		return 0, self.Err
+	}
+	if err := self.Port.Pack(FromSlice(p)); err != nil {
+		self.Err = err
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// StreamNetPort runs stream passes directly on its connection. Decoders read
+// from a bufio.Reader kept across frames.
+type StreamNetPort struct {
+	conn    net.Conn
+	rbuf    *bufio.Reader
+	timeout time.Duration
+	pack    StreamPass
+	unpack  StreamPass
+}
+
+func NewStreamNetPortWithTimeout(c net.Conn, timeout int, pack, unpack StreamPass) *StreamNetPort {
+	return &StreamNetPort{
+		conn:    c,
+		rbuf:    bufio.NewReader(c),
+		timeout: time.Duration(timeout) * time.Second,
+		pack:    pack,
+		unpack:  unpack,
+	}
+}
+
+func NewStreamNetPort(c net.Conn, pack, unpack StreamPass) *StreamNetPort {
+	return NewStreamNetPortWithTimeout(c, DEFAULT_TIMEOUT, pack, unpack)
+}
+
+func (self *StreamNetPort) UnpackTo(w io.Writer) error {
+	if err := self.conn.SetReadDeadline(time.Now().Add(self.timeout)); err != nil {
+		return Tr(err)
+	}
+	if err := self.unpack.RunStream(w, self.rbuf); err != nil {
+		if errors.Is(err, io.EOF) {
+			log.Println(self.conn.RemoteAddr(), "->", self.conn.LocalAddr(), "is closed")
+		}
+		return Tr(err)
+	}
+	return nil
+}
+
+func (self *StreamNetPort) Unpack(b *IoVec) error {
+	return self.UnpackTo(b)
+}
+
+func (self *StreamNetPort) Pack(b *IoVec) error {
+	if err := self.conn.SetWriteDeadline(time.Now().Add(self.timeout)); err != nil {
+		return Tr(err)
+	}
+	return Tr(self.pack.RunStream(self.conn, b))
+}
+
+func (self *StreamNetPort) CloseRead() error {
+	return CloseRead(self.conn)
+}
+
+func (self *StreamNetPort) CloseWrite() error {
+	return CloseWrite(self.conn)
+}
+
+func (self *StreamNetPort) Close() error {
+	return self.conn.Close()
+}
+
+func (self *StreamNetPort) LocalAddr() net.Addr {
+	return self.conn.LocalAddr()
+}
+
+func (self *StreamNetPort) RemoteAddr() net.Addr {
+	return self.conn.RemoteAddr()
+}
@@ -124,6 +124,11 @@ func (self *Map[K, V]) LoadAndDelete(key K) (value V, loaded bool) {
 	return v.(V), loaded
 }
 
+// CompareAndDelete deletes the entry of key if its value is old.
+func (self *Map[K, V]) CompareAndDelete(key K, old V) bool {
+	return self.m.CompareAndDelete(key, old)
+}
+
 func (self *Map[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
 	a, loaded := self.m.LoadOrStore(key, value)
 	return a.(V), loaded
@@ -32,6 +32,9 @@ func (self *SimpleSwitch) Run() {
 }
 
 func (self *SimpleSwitch) switchTraffic(in, out Port) error {
+	if sp, ok := in.(StreamPort); ok {
+		return self.switchStream(sp, out)
+	}
 	for {
 		var b IoVec
 		if err := in.Unpack(&b); err != nil {
@@ -46,6 +49,28 @@ func (self *SimpleSwitch) switchTraffic(in, out Port) error {
 			in.CloseRead()
 			return Tr(err)
 		}
+		if r, ok := in.(Recycler); ok {
+			r.Recycle()
+		}
+	}
+}
+
+// Frames are forwarded as they arrive, every write of the stream is packed as
+// a frame.
+func (self *SimpleSwitch) switchStream(in StreamPort, out Port) error {
+	w := &PortWriter{Port: out}
+	for {
+		if err := in.UnpackTo(w); err != nil {
+			if w.Err != nil {
+				in.CloseRead()
+				return Tr(err)
+			}
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			out.CloseWrite()
+			return Tr(err)
+		}
 	}
 }
 
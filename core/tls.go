@@ -1,12 +1,23 @@
 package core
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
 	"math/big"
+	"os"
+	"strings"
+	"time"
 )
 
 func CreateBarebonesTLSConfig(proto string) (*tls.Config, error) {
@@ -30,3 +41,141 @@ func CreateBarebonesTLSConfig(proto string) (*tls.Config, error) {
 		NextProtos:   []string{proto},
 	}, nil
 }
+
+func CertificateFingerprint(der []byte) string {
+	h := sha256.Sum256(der)
+	return hex.EncodeToString(h[:])
+}
+
+func createCertificate(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "bxrx"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"bxrx"},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, certPEM, 0644)
+}
+
+// Loads the key pair from certFile and keyFile. If neither of them exists, a
+// self-signed ECDSA certificate is generated and persisted to them first.
+func LoadOrCreateCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	if certFile == "" || keyFile == "" {
+		return tls.Certificate{}, fmt.Errorf("Both certificate and key files must be given")
+	}
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if errors.Is(certErr, fs.ErrNotExist) && errors.Is(keyErr, fs.ErrNotExist) {
+		if err := createCertificate(certFile, keyFile); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return cert, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	return cert, err
+}
+
+// If clientCAFile is not empty, clients must present certificates verified by
+// certificates in it.
+func CreateTLSServerConfig(cert tls.Certificate, clientCAFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+	}
+	if clientCAFile != "" {
+		buf, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("No certificate found in %s", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// If pin is not empty, the server is authenticated by the SHA-256 fingerprint
+// of its certificate instead of the certificate chain. Otherwise the chain is
+// verified by system roots, and a self-signed certificate, e.g., created by
+// LoadOrCreateCertificate, fails with its fingerprint to pin. cert, if not
+// nil, is presented to servers requiring client certificates.
+func CreateTLSClientConfig(serverName string, cert *tls.Certificate, pin string) *tls.Config {
+	config := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS13,
+	}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	config.InsecureSkipVerify = true
+	if pin != "" {
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("No certificate presented by server")
+			}
+			if fp := CertificateFingerprint(rawCerts[0]); !strings.EqualFold(fp, pin) {
+				return fmt.Errorf("Certificate fingerprint %s mismatches pinned %s", fp, pin)
+			}
+			return nil
+		}
+		return config
+	}
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		return verifyServerCertificate(serverName, cs.PeerCertificates)
+	}
+	return config
+}
+
+// Verifies certs as crypto/tls does by default.
+func verifyServerCertificate(serverName string, certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("No certificate presented by server")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	leaf := certs[0]
+	_, err := leaf.Verify(opts)
+	if err == nil {
+		return nil
+	}
+	if leaf.CheckSignature(leaf.SignatureAlgorithm, leaf.RawTBSCertificate, leaf.Signature) == nil {
+		return fmt.Errorf("Server certificate is self-signed, pin its fingerprint %s: %w", CertificateFingerprint(leaf.Raw), err)
+	}
+	return err
+}
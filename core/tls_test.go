@@ -0,0 +1,43 @@
+package core
+
+import (
+	"crypto/x509"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadOrCreateCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	c0, err := LoadOrCreateCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, err := LoadOrCreateCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if CertificateFingerprint(c0.Certificate[0]) != CertificateFingerprint(c1.Certificate[0]) {
+		t.Fail()
+	}
+}
+
+func TestLoadOrCreateCertificateWithoutKey(t *testing.T) {
+	if _, err := LoadOrCreateCertificate(filepath.Join(t.TempDir(), "cert.pem"), ""); err == nil {
+		t.Fail()
+	}
+}
+
+func TestSelfSignedServerCertificate(t *testing.T) {
+	dir := t.TempDir()
+	cert, err := LoadOrCreateCertificate(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifyServerCertificate("example.com", []*x509.Certificate{cert.Leaf})
+	if err == nil || !strings.Contains(err.Error(), CertificateFingerprint(cert.Certificate[0])) {
+		t.Fatal(err)
+	}
+}
@@ -1,3 +1,3 @@
 module github.com/bzEq/bxrx
 
-go 1.18
+go 1.20
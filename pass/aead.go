@@ -0,0 +1,100 @@
+// Copyright (c) 2026 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package pass
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bzEq/bxrx/core"
+)
+
+const AEAD_KEY_SIZE = 32
+
+// ErrDecryption is returned by AEADDecoder when a frame fails authentication,
+// i.e., it's forged, corrupted or sealed with a different key.
+var ErrDecryption = errors.New("Decryption failed")
+
+func KeyFromPassphrase(s string) []byte {
+	k := sha256.Sum256([]byte(s))
+	return k[:]
+}
+
+// DeriveKey is HKDF-SHA256 (RFC 5869) producing a key of AEAD_KEY_SIZE bytes.
+func DeriveKey(secret, salt []byte, info string) []byte {
+	h := hmac.New(sha256.New, salt)
+	h.Write(secret)
+	prk := h.Sum(nil)
+	h = hmac.New(sha256.New, prk)
+	h.Write([]byte(info))
+	h.Write([]byte{1})
+	return h.Sum(nil)
+}
+
+func NewAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != AEAD_KEY_SIZE {
+		return nil, fmt.Errorf("Key length %d is abnormal, expecting %d", len(key), AEAD_KEY_SIZE)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Frame layout: nonce | ciphertext | tag.
+// Frames pass through unchanged if AEAD is nil, so that a pipeline without
+// pre-shared key can still be keyed after a handshake.
+// AEAD must not be replaced while Run is in progress.
+type AEADEncoder struct {
+	cipher.AEAD
+}
+
+// The frame is copied once into the sealed frame and encrypted in place.
+func (self *AEADEncoder) Run(b *core.IoVec) error {
+	if self.AEAD == nil {
+		return nil
+	}
+	ns := self.NonceSize()
+	buf := make([]byte, ns, ns+b.Len()+self.Overhead())
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return core.Tr(err)
+	}
+	buf = b.AppendTo(buf)
+	*b = core.IoVec{}
+	b.Take(self.Seal(buf[:ns], buf[:ns], buf[ns:], nil))
+	return nil
+}
+
+type AEADDecoder struct {
+	cipher.AEAD
+}
+
+func (self *AEADDecoder) Run(b *core.IoVec) error {
+	if self.AEAD == nil {
+		return nil
+	}
+	return core.Tr(core.RunContiguous(self, b))
+}
+
+// Frames are decrypted in place.
+func (self *AEADDecoder) RunContiguous(buf []byte) ([]byte, error) {
+	if self.AEAD == nil {
+		return buf, nil
+	}
+	ns := self.NonceSize()
+	if len(buf) < ns+self.Overhead() {
+		return nil, fmt.Errorf("%w: frame of %d bytes is too short", ErrDecryption, len(buf))
+	}
+	plain, err := self.Open(buf[ns:ns], buf[:ns], buf[ns:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrDecryption, err)
+	}
+	return plain, nil
+}
@@ -1,33 +1,51 @@
 // Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
 
+//go:build cgo && !purego
+
 #include <algorithm>
 #include <stddef.h>
 #include <stdint.h>
+#include <string.h>
+
+namespace {
+
+// Buffers from Go are not necessarily aligned to 8 bytes, words are accessed
+// by memcpy, which compilers lower to plain loads and stores.
+inline uint64_t Load64(const uint8_t *p) {
+  uint64_t v;
+  memcpy(&v, p, sizeof(v));
+  return v;
+}
+
+inline void Store64(uint8_t *p, uint64_t v) { memcpy(p, &v, sizeof(v)); }
+
+} // namespace
 
 extern "C" {
 
 void ByteSwap(uint8_t *__restrict__ dst, const uint8_t *__restrict__ src,
               size_t len) {
   static constexpr size_t n = sizeof(uint64_t);
-  auto dst64 = reinterpret_cast<uint64_t *>(dst);
-  auto src64 = reinterpret_cast<const uint64_t *>(src);
   const size_t m = len / n;
   const size_t r = m * n;
   for (size_t i = 0; i < m; ++i)
-    dst64[i] = __builtin_bswap64(src64[m - 1 - i]);
+    Store64(dst + i * n, __builtin_bswap64(Load64(src + (m - 1 - i) * n)));
   for (size_t i = 0; i < len - r; ++i)
     dst[r + i] = src[len - 1 - i];
 }
 
 void ByteSwapInPlace(uint8_t *__restrict__ buf, size_t len) {
   static constexpr size_t n = sizeof(uint64_t);
-  auto buf64 = reinterpret_cast<uint64_t *>(buf);
   const size_t m = len / n;
   const size_t r = m * n;
-  std::reverse(buf64, buf64 + m);
-  for (size_t i = 0; i < m; ++i)
-    buf64[i] = __builtin_bswap64(buf64[i]);
+  for (size_t i = 0, j = m - 1; i < m / 2; ++i, --j) {
+    uint64_t a = Load64(buf + i * n);
+    uint64_t b = Load64(buf + j * n);
+    Store64(buf + i * n, __builtin_bswap64(b));
+    Store64(buf + j * n, __builtin_bswap64(a));
+  }
+  if (m % 2)
+    Store64(buf + m / 2 * n, __builtin_bswap64(Load64(buf + m / 2 * n)));
   std::reverse(buf + r, buf + len);
 }
-
 }
@@ -0,0 +1,148 @@
+// Copyright (c) 2026 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package pass
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/bzEq/bxrx/core"
+)
+
+const DEFAULT_RECORD_SIZE = 64 << 10
+
+// Records grow by passes run on them, so decoders accept larger ones.
+const DEFAULT_MAX_RECORD_SIZE = 1 << 20
+
+// ChunkedHTTPEncoder carries every frame by an HTTP request with chunked
+// body. The frame is split into records of at most Size bytes, every record
+// is run by Record independently and prefixed by its length, so the peer's
+// ChunkedHTTPDecoder forwards records as they arrive. Records are delimited
+// by their lengths rather than chunks, since intermediaries might re-chunk
+// the body.
+type ChunkedHTTPEncoder struct {
+	Record core.Pass
+	Size   int
+}
+
+func NewChunkedHTTPEncoder(record core.Pass) *ChunkedHTTPEncoder {
+	return &ChunkedHTTPEncoder{record, DEFAULT_RECORD_SIZE}
+}
+
+func (self *ChunkedHTTPEncoder) RunStream(w io.Writer, r io.Reader) error {
+	body := &recordReader{src: r, pass: self.Record, size: self.Size}
+	req, err := http.NewRequest("POST", "/", body)
+	if err != nil {
+		return core.Tr(err)
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	return core.Tr(req.Write(w))
+}
+
+// Encodes records of src lazily as the body is read.
+type recordReader struct {
+	src  io.Reader
+	pass core.Pass
+	size int
+	rec  core.IoVec
+}
+
+func (self *recordReader) next() error {
+	var rec core.IoVec
+	// Records of an IoVec are views of it.
+	if v, ok := self.src.(*core.IoVec); ok {
+		if v.Len() == 0 {
+			return io.EOF
+		}
+		rec = v.Slice(0, self.size)
+		v.Skip(rec.Len())
+	} else {
+		buf := make([]byte, self.size)
+		n, err := io.ReadFull(self.src, buf)
+		if n == 0 || (err != nil && !errors.Is(err, io.ErrUnexpectedEOF)) {
+			return err
+		}
+		rec.Take(buf[:n])
+	}
+	if err := self.pass.Run(&rec); err != nil {
+		return err
+	}
+	rec.PrependUint32(uint32(rec.Len()))
+	self.rec = rec
+	return nil
+}
+
+func (self *recordReader) Read(p []byte) (int, error) {
+	for self.rec.Len() == 0 {
+		if err := self.next(); err != nil {
+			return 0, err
+		}
+	}
+	return self.rec.Read(p)
+}
+
+// ChunkedHTTPDecoder decodes requests of ChunkedHTTPEncoder. It must read from
+// a bufio.Reader kept across frames, e.g., the one of core.StreamNetPort.
+// Every decoded record is written to w by one Write, so at most a record is
+// held in memory.
+type ChunkedHTTPDecoder struct {
+	Record core.Pass
+	Limit  int
+}
+
+func NewChunkedHTTPDecoder(record core.Pass) *ChunkedHTTPDecoder {
+	return &ChunkedHTTPDecoder{record, DEFAULT_MAX_RECORD_SIZE}
+}
+
+func (self *ChunkedHTTPDecoder) RunStream(w io.Writer, r io.Reader) error {
+	rbuf, ok := r.(*bufio.Reader)
+	if !ok {
+		return core.Tr(fmt.Errorf("Chunked HTTP decoder needs a buffered reader"))
+	}
+	req, err := http.ReadRequest(rbuf)
+	if err != nil {
+		return core.Tr(err)
+	}
+	defer req.Body.Close()
+	var h [4]byte
+	for {
+		if _, err := io.ReadFull(req.Body, h[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return core.Tr(err)
+		}
+		l := binary.BigEndian.Uint32(h[:])
+		if l == 0 || int64(l) > int64(self.Limit) {
+			return core.Tr(fmt.Errorf("Record length %d is abnormal", l))
+		}
+		if err := self.record(w, req.Body, int(l)); err != nil {
+			return core.Tr(err)
+		}
+	}
+}
+
+func (self *ChunkedHTTPDecoder) record(w io.Writer, r io.Reader, l int) error {
+	buf := core.GetBuffer(l)
+	defer core.PutBuffer(buf)
+	if n, err := io.ReadFull(r, buf); err != nil {
+		return fmt.Errorf("Record length %d, %d bytes read: %w", l, n, err)
+	}
+	var rec core.IoVec
+	rec.Take(buf)
+	if err := self.Record.Run(&rec); err != nil {
+		return err
+	}
+	if rec.Len() == 0 {
+		return nil
+	}
+	_, err := w.Write(rec.Coalesce())
+	return err
+}
@@ -0,0 +1,87 @@
+package pass
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/bzEq/bxrx/core"
+)
+
+// Records every write.
+type writeRecorder struct {
+	bytes.Buffer
+	writes []int
+}
+
+func (self *writeRecorder) Write(p []byte) (int, error) {
+	self.writes = append(self.writes, len(p))
+	return self.Buffer.Write(p)
+}
+
+func testChunkedHTTP(t *testing.T, frame func(s []byte) io.Reader) {
+	pmb := &core.PackUnpackPassManagerBuilder{}
+	pmb.AddPairedPasses(&OBFSEncoder{}, &OBFSDecoder{})
+	pmb.AddPairedPasses(&TailPaddingEncoder{}, &TailPaddingDecoder{})
+	enc := NewChunkedHTTPEncoder(pmb.BuildPackPassManager())
+	enc.Size = 1000
+	dec := NewChunkedHTTPDecoder(pmb.BuildUnpackPassManager())
+	var wire bytes.Buffer
+	rbuf := bufio.NewReader(&wire)
+	for _, l := range []int{1, 999, 1000, 1001, 12345} {
+		s := generateRandomSlice(l)
+		// Passes run in place.
+		if err := enc.RunStream(&wire, frame(append([]byte(nil), s...))); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(wire.String(), "Transfer-Encoding: chunked") {
+			t.Fatal("Body is not chunked")
+		}
+		w := &writeRecorder{}
+		if err := dec.RunStream(w, rbuf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(w.Bytes(), s) {
+			t.Fatal("Frame of", l, "bytes is corrupted")
+		}
+		if len(w.writes) != (l+enc.Size-1)/enc.Size {
+			t.Fatal(len(w.writes), "records of", l, "bytes")
+		}
+		for _, n := range w.writes {
+			if n > enc.Size {
+				t.Fatal("Record of", n, "bytes")
+			}
+		}
+	}
+}
+
+func TestChunkedHTTP(t *testing.T) {
+	testChunkedHTTP(t, func(s []byte) io.Reader {
+		return core.FromSlice(s)
+	})
+}
+
+func TestChunkedHTTPFromReader(t *testing.T) {
+	testChunkedHTTP(t, func(s []byte) io.Reader {
+		return bytes.NewReader(s)
+	})
+}
+
+func TestChunkedHTTPRecordTooLarge(t *testing.T) {
+	enc := NewChunkedHTTPEncoder(&core.PassManager{})
+	var wire bytes.Buffer
+	if err := enc.RunStream(&wire, core.FromSlice(make([]byte, 100))); err != nil {
+		t.Fatal(err)
+	}
+	dec := NewChunkedHTTPDecoder(&core.PassManager{})
+	dec.Limit = 99
+	var b bytes.Buffer
+	if err := dec.RunStream(&b, bufio.NewReader(&wire)); err == nil {
+		t.Fail()
+	}
+	if err := dec.RunStream(&b, &wire); err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2026 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package pass
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/bzEq/bxrx/core"
+)
+
+// Frames are read by core.RawNetPort in at most core.MAX_POOLED_BUFFER_SIZE
+// bytes, and grow by passes run on them, so decoders accept slightly larger
+// ones.
+const DEFAULT_MAX_FRAME_SIZE = core.MAX_POOLED_BUFFER_SIZE + 64<<10
+
+// Payloads are read in chunks of at most READ_CHUNK_SIZE, so lengths told by
+// peers don't allocate buffers before their bytes arrive.
+const READ_CHUNK_SIZE = 64 << 10
+
+// Reads l bytes of r as segments appended to b. Nothing is appended on error,
+// the number of bytes read is returned.
+func readChunks(r io.Reader, l int64, b *core.IoVec) (int64, error) {
+	var v core.IoVec
+	for int64(v.Len()) < l {
+		size := l - int64(v.Len())
+		if size > READ_CHUNK_SIZE {
+			size = READ_CHUNK_SIZE
+		}
+		buf := core.GetBuffer(int(size))
+		n, err := io.ReadFull(r, buf)
+		if err != nil {
+			return int64(v.Len() + n), err
+		}
+		v.Take(buf)
+	}
+	b.Append(&v)
+	return l, nil
+}
+
+// Frame layout: length (uint32, big endian) | payload.
+// Compared to the HTTP codec, it's cheap but easy to be identified, thus
+// should only be used on trusted links.
+type FrameEncoder struct {
+	io.Writer
+	Max int
+}
+
+func NewFrameEncoder(w io.Writer) *FrameEncoder {
+	return &FrameEncoder{w, DEFAULT_MAX_FRAME_SIZE}
+}
+
+func (self *FrameEncoder) Run(b *core.IoVec) error {
+	l := b.Len()
+	if l > self.Max {
+		return core.Tr(fmt.Errorf("Frame length %d exceeds limit %d", l, self.Max))
+	}
+	var h [4]byte
+	binary.BigEndian.PutUint32(h[:], uint32(l))
+	b.Prepend(h[:])
+	_, err := b.WriteTo(self.Writer)
+	return core.Tr(err)
+}
+
+type FrameDecoder struct {
+	rbuf *bufio.Reader
+	Max  int
+}
+
+func NewFrameDecoder(r io.Reader) *FrameDecoder {
+	return &FrameDecoder{bufio.NewReader(r), DEFAULT_MAX_FRAME_SIZE}
+}
+
+func (self *FrameDecoder) Run(b *core.IoVec) error {
+	var h [4]byte
+	if _, err := io.ReadFull(self.rbuf, h[:]); err != nil {
+		return core.Tr(err)
+	}
+	l := binary.BigEndian.Uint32(h[:])
+	if int64(l) > int64(self.Max) {
+		return core.Tr(fmt.Errorf("Frame length %d exceeds limit %d", l, self.Max))
+	}
+	_, err := readChunks(self.rbuf, int64(l), b)
+	return core.Tr(err)
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2026 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package pass
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bzEq/bxrx/core"
+)
+
+// SizeDistribution is a distribution of frame sizes. It's loaded from text,
+// one size per line optionally followed by its count, e.g.,
+//
+//	# size count
+//	1400 120
+//	583 17
+//	52
+//
+// Lines starting with '#' are ignored, a size without count counts once, so
+// sizes recorded from real traffic can be loaded as they are.
+type SizeDistribution struct {
+	sizes []int
+	// Cumulative counts of sizes.
+	counts []int
+}
+
+func ParseSizeDistribution(r io.Reader) (*SizeDistribution, error) {
+	hist := make(map[int]int)
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		t := strings.TrimSpace(s.Text())
+		if t == "" || strings.HasPrefix(t, "#") {
+			continue
+		}
+		fields := strings.Fields(t)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("Line %d of size distribution: expecting size and optional count", line)
+		}
+		size, err := strconv.Atoi(fields[0])
+		if err != nil || size <= 0 || size > DEFAULT_MAX_FRAME_SIZE {
+			return nil, fmt.Errorf("Line %d of size distribution: size must be an integer from 1 to %d", line, DEFAULT_MAX_FRAME_SIZE)
+		}
+		count := 1
+		if len(fields) == 2 {
+			count, err = strconv.Atoi(fields[1])
+			if err != nil || count <= 0 {
+				return nil, fmt.Errorf("Line %d of size distribution: count must be a positive integer", line)
+			}
+		}
+		hist[size] += count
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(hist) == 0 {
+		return nil, fmt.Errorf("Size distribution is empty")
+	}
+	d := &SizeDistribution{}
+	for size := range hist {
+		d.sizes = append(d.sizes, size)
+	}
+	sort.Ints(d.sizes)
+	total := 0
+	for _, size := range d.sizes {
+		total += hist[size]
+		d.counts = append(d.counts, total)
+	}
+	return d, nil
+}
+
+func LoadSizeDistribution(path string) (*SizeDistribution, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseSizeDistribution(f)
+}
+
+// Digest identifies the distribution, which is identical for distributions
+// of identical sizes and counts.
+func (self *SizeDistribution) Digest() string {
+	h := sha256.New()
+	prev := 0
+	for i, size := range self.sizes {
+		fmt.Fprintf(h, "%d %d\n", size, self.counts[i]-prev)
+		prev = self.counts[i]
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (self *SizeDistribution) Sample() int {
+	r := mrand.Intn(self.counts[len(self.counts)-1])
+	return self.sizes[sort.SearchInts(self.counts, r+1)]
+}
+
+func (self *SizeDistribution) Max() int {
+	return self.sizes[len(self.sizes)-1]
+}
+
+// Every fragment ends with a trailer, the length of data in the fragment and
+// whether it's the last fragment of a frame. Bytes between the data and the
+// trailer are padding.
+const MORPH_TRAILER_SIZE = 5
+
+// MorphEncoder pads or splits each frame into fragments whose sizes follow
+// Dist, and runs Next, i.e., passes below it, on every fragment. Thus it must
+// be the last pass of its pass manager.
+type MorphEncoder struct {
+	Next core.Pass
+	Dist *SizeDistribution
+	// Bytes added by Next to every fragment, which are subtracted from sampled
+	// sizes.
+	Overhead int
+	// Bytes spent on padding and extra fragments are kept within MaxOverhead
+	// times of data bytes. Frames are sent as they are once it's exhausted.
+	MaxOverhead float64
+	budget      int
+}
+
+// Padding and the trailer are appended as segments to data.
+func (self *MorphEncoder) fragment(data core.IoVec, padding int, last bool) error {
+	t := make([]byte, MORPH_TRAILER_SIZE, MORPH_TRAILER_SIZE+padding)
+	binary.BigEndian.PutUint32(t[:4], uint32(data.Len()))
+	if last {
+		t[4] = 1
+	}
+	if padding > 0 {
+		p := t[MORPH_TRAILER_SIZE : MORPH_TRAILER_SIZE+padding]
+		if _, err := io.ReadFull(rand.Reader, p); err != nil {
+			return core.Tr(err)
+		}
+		data.Take(p)
+	}
+	data.Take(t[:MORPH_TRAILER_SIZE])
+	return self.Next.Run(&data)
+}
+
+func (self *MorphEncoder) Run(b *core.IoVec) error {
+	data := *b
+	*b = core.IoVec{}
+	l := data.Len()
+	// Don't let idle links save up unbounded budget for bursts.
+	if limit := self.Dist.Max(); self.budget > limit {
+		self.budget = limit
+	}
+	self.budget += int(float64(l) * self.MaxOverhead)
+	cost := self.Overhead + MORPH_TRAILER_SIZE
+	for {
+		capacity := self.Dist.Sample() - cost
+		if l <= capacity {
+			padding := capacity - l
+			if padding > self.budget {
+				padding = self.budget
+			}
+			if padding < 0 {
+				padding = 0
+			}
+			self.budget -= padding
+			return core.Tr(self.fragment(data, padding, true))
+		}
+		if capacity <= 0 || self.budget < cost {
+			return core.Tr(self.fragment(data, 0, true))
+		}
+		self.budget -= cost
+		rest := data.Split(capacity)
+		if err := self.fragment(data, 0, false); err != nil {
+			return core.Tr(err)
+		}
+		data = rest
+		l -= capacity
+	}
+}
+
+// MorphDecoder runs Prev, i.e., passes below it, until the last fragment of a
+// frame is received. Thus it must be the first pass of its pass manager.
+type MorphDecoder struct {
+	Prev core.Pass
+}
+
+func (self *MorphDecoder) Run(b *core.IoVec) error {
+	var frame core.IoVec
+	for {
+		var v core.IoVec
+		if err := self.Prev.Run(&v); err != nil {
+			return core.Tr(err)
+		}
+		buf := v.Consume()
+		if len(buf) < MORPH_TRAILER_SIZE {
+			return core.Tr(fmt.Errorf("Fragment of %d bytes is too short", len(buf)))
+		}
+		t := buf[len(buf)-MORPH_TRAILER_SIZE:]
+		l := binary.BigEndian.Uint32(t[:4])
+		if int64(l) > int64(len(buf)-MORPH_TRAILER_SIZE) {
+			return core.Tr(fmt.Errorf("Fragment of %d bytes claims %d bytes of data", len(buf), l))
+		}
+		frame.Take(buf[:l])
+		if frame.Len() > DEFAULT_MAX_FRAME_SIZE {
+			return core.Tr(fmt.Errorf("Morphed frame exceeds limit %d", DEFAULT_MAX_FRAME_SIZE))
+		}
+		if t[4] != 0 {
+			b.Take(frame.Consume())
+			return nil
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package pass
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bzEq/bxrx/core"
+)
+
+type sizeRecorder struct {
+	sizes []int
+}
+
+func (self *sizeRecorder) Run(b *core.IoVec) error {
+	self.sizes = append(self.sizes, b.Len())
+	return nil
+}
+
+func TestParseSizeDistribution(t *testing.T) {
+	d, err := ParseSizeDistribution(strings.NewReader("# size count\n1400 3\n\n52\n1400\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.sizes) != 2 || d.counts[1] != 5 || d.Max() != 1400 {
+		t.Fatal(d)
+	}
+	for _, s := range []string{"", "# nothing", "0", "-1 1", "100 0", "100 1 1", "x"} {
+		if _, err := ParseSizeDistribution(strings.NewReader(s)); err == nil {
+			t.Errorf("%q should be rejected", s)
+		}
+	}
+}
+
+func testMorph(t *testing.T, dist string, maxOverhead float64) []int {
+	d, err := ParseSizeDistribution(strings.NewReader(dist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	rec := &sizeRecorder{}
+	next := core.NewPassManager([]core.Pass{rec, NewFrameEncoder(buf)})
+	enc := &MorphEncoder{Next: next, Dist: d, MaxOverhead: maxOverhead}
+	dec := &MorphDecoder{Prev: NewFrameDecoder(buf)}
+	testCodec(t, enc, dec)
+	for _, l := range []int{0, 1, 1000} {
+		s := generateRandomSlice(l)
+		v := core.FromSlice(s)
+		if err := enc.Run(v); err != nil {
+			t.Fatal(err)
+		}
+		if err := dec.Run(v); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v.Consume(), s) {
+			t.Fatal("Slice not equal after enc and dec")
+		}
+	}
+	return rec.sizes
+}
+
+func TestMorph(t *testing.T) {
+	for _, s := range testMorph(t, "64\n100 2", 100) {
+		if s != 64 && s != 100 {
+			t.Fatal(s)
+		}
+	}
+}
+
+func TestMorphWithoutBudget(t *testing.T) {
+	sizes := testMorph(t, "64", 0)
+	// Frames are neither padded nor split.
+	if len(sizes) != testCodecFrames+3 {
+		t.Fatal(sizes)
+	}
+}
@@ -2,25 +2,16 @@
 
 package pass
 
-// #cgo CFLAGS: -O3
-// #cgo amd64 CFLAGS: -march=native
-// #cgo arm64 CFLAGS: -mcpu=native
-// #include "bytes.h"
-import "C"
-
 import (
-	"unsafe"
-)
+	"encoding/binary"
+	"math/bits"
 
-func byteSwapInPlace(b []byte) {
-	l := len(b)
-	if l == 0 {
-		return
-	}
-	ptr := unsafe.Pointer(&b[0])
-	C.ByteSwapInPlace(ptr, C.size_t(l))
-}
+	"github.com/bzEq/bxrx/core"
+)
 
+// FastOBFS reverses bytes of every frame. It's implemented in C if cgo is
+// enabled, unless the purego tag is set, and in Go otherwise. Both are
+// byte-identical.
 type FastOBFS struct{}
 
 func (self *FastOBFS) Encode(p []byte) ([]byte, error) {
@@ -32,3 +23,54 @@ func (self *FastOBFS) Decode(p []byte) ([]byte, error) {
 	byteSwapInPlace(p)
 	return p, nil
 }
+
+// Same as ByteSwapInPlace in bytes.cc, i.e., bytes of the longest prefix
+// whose length is a multiple of 8 and bytes of the rest are reversed
+// respectively.
+func byteSwapInPlaceGo(b []byte) {
+	m := len(b) / 8
+	for i, j := 0, m-1; i < j; i, j = i+1, j-1 {
+		x := binary.LittleEndian.Uint64(b[i*8:])
+		y := binary.LittleEndian.Uint64(b[j*8:])
+		binary.LittleEndian.PutUint64(b[i*8:], bits.ReverseBytes64(y))
+		binary.LittleEndian.PutUint64(b[j*8:], bits.ReverseBytes64(x))
+	}
+	if m%2 != 0 {
+		k := m / 2 * 8
+		binary.LittleEndian.PutUint64(b[k:], bits.ReverseBytes64(binary.LittleEndian.Uint64(b[k:])))
+	}
+	reverseBytes(b[m*8:])
+}
+
+func reverseBytes(b []byte) {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+}
+
+// Same as byteSwapInPlace on the coalesced IoVec, but segments are swapped in
+// place.
+func byteSwapIoVec(b *core.IoVec) {
+	if segs := b.Segments(); len(segs) == 1 {
+		byteSwapInPlace(segs[0])
+		return
+	}
+	tail := b.Split(b.Len() / 8 * 8)
+	*b = reverseIoVec(b)
+	tail = reverseIoVec(&tail)
+	b.Append(&tail)
+}
+
+func reverseIoVec(v *core.IoVec) (r core.IoVec) {
+	segs := v.Segments()
+	for i := len(segs) - 1; i >= 0; i-- {
+		s := segs[i]
+		if len(s)%8 == 0 {
+			byteSwapInPlace(s)
+		} else {
+			reverseBytes(s)
+		}
+		r.Take(s)
+	}
+	return
+}
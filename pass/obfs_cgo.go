@@ -0,0 +1,23 @@
+// Copyright (c) 2023 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+//go:build cgo && !purego
+
+package pass
+
+// #cgo CFLAGS: -O3
+// #cgo CXXFLAGS: -O3
+// #include "bytes.h"
+import "C"
+
+import (
+	"unsafe"
+)
+
+func byteSwapInPlace(b []byte) {
+	l := len(b)
+	if l == 0 {
+		return
+	}
+	ptr := unsafe.Pointer(&b[0])
+	C.ByteSwapInPlace(ptr, C.size_t(l))
+}
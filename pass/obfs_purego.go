@@ -0,0 +1,9 @@
+// Copyright (c) 2026 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+//go:build !cgo || purego
+
+package pass
+
+func byteSwapInPlace(b []byte) {
+	byteSwapInPlaceGo(b)
+}
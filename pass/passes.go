@@ -5,11 +5,15 @@ package pass
 import (
 	"bufio"
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
+	"sort"
 
 	"github.com/bzEq/bxrx/core"
 )
@@ -42,12 +46,7 @@ type OBFSEncoder struct {
 }
 
 func (self *OBFSEncoder) Run(b *core.IoVec) error {
-	buf := b.Consume()
-	buf, err := self.FastOBFS.Encode(buf)
-	if err != nil {
-		return core.Tr(err)
-	}
-	b.Take(buf)
+	byteSwapIoVec(b)
 	return nil
 }
 
@@ -56,36 +55,80 @@ type OBFSDecoder struct {
 }
 
 func (self *OBFSDecoder) Run(b *core.IoVec) error {
-	buf := b.Consume()
-	buf, err := self.FastOBFS.Decode(buf)
-	if err != nil {
-		return core.Tr(err)
-	}
-	b.Take(buf)
+	byteSwapIoVec(b)
 	return nil
 }
 
+// The selector of RandomEncoder and RandomDecoder, i.e., the index of the
+// chosen PM, is masked by HMAC-SHA256 of a per-frame counter, so it reveals
+// nothing to observers without the key. Both ends must see frames in the same
+// order.
+type randomSelector struct {
+	key []byte
+	n   uint64
+}
+
+func (self *randomSelector) mask() byte {
+	var c [8]byte
+	binary.BigEndian.PutUint64(c[:], self.n)
+	self.n++
+	h := hmac.New(sha256.New, self.key)
+	h.Write(c[:])
+	return h.Sum(nil)[0]
+}
+
+var errNoPM = errors.New("No pass manager to select")
+
 type RandomEncoder struct {
 	pms []*core.PassManager
+	// Cumulative weights of pms.
+	weights []int
+	randomSelector
+}
+
+func NewRandomEncoder(key []byte) *RandomEncoder {
+	return &RandomEncoder{randomSelector: randomSelector{key: key}}
 }
 
 func (self *RandomEncoder) AddPM(p *core.PassManager) {
+	self.AddWeightedPM(p, 1)
+}
+
+// p is chosen with probability of weight divided by the sum of weights.
+func (self *RandomEncoder) AddWeightedPM(p *core.PassManager, weight int) {
+	if weight <= 0 {
+		panic(fmt.Errorf("Weight %d is not positive", weight))
+	}
+	if len(self.weights) != 0 {
+		weight += self.weights[len(self.weights)-1]
+	}
 	self.pms = append(self.pms, p)
+	self.weights = append(self.weights, weight)
 }
 
 func (self *RandomEncoder) Run(b *core.IoVec) error {
-	n := int(rand.Uint32())
-	if err := self.pms[n%len(self.pms)].Run(b); err != nil {
+	if len(self.pms) == 0 {
+		return core.Tr(errNoPM)
+	}
+	if len(self.pms) > 256 {
+		return core.Tr(fmt.Errorf("%d pass managers can't be selected by a byte", len(self.pms)))
+	}
+	r := rand.Intn(self.weights[len(self.weights)-1])
+	n := sort.SearchInts(self.weights, r+1)
+	if err := self.pms[n].Run(b); err != nil {
 		return core.Tr(err)
 	}
-	var padding bytes.Buffer
-	padding.WriteByte(byte(n))
-	b.Take(padding.Bytes())
+	b.Take([]byte{byte(n) ^ self.mask()})
 	return nil
 }
 
 type RandomDecoder struct {
 	pms []*core.PassManager
+	randomSelector
+}
+
+func NewRandomDecoder(key []byte) *RandomDecoder {
+	return &RandomDecoder{randomSelector: randomSelector{key: key}}
 }
 
 func (self *RandomDecoder) AddPM(p *core.PassManager) {
@@ -93,13 +136,19 @@ func (self *RandomDecoder) AddPM(p *core.PassManager) {
 }
 
 func (self *RandomDecoder) Run(b *core.IoVec) error {
+	if len(self.pms) == 0 {
+		return core.Tr(errNoPM)
+	}
 	t, err := b.LastByte()
 	if err != nil {
 		return core.Tr(err)
 	}
-	n := int(t)
+	n := int(t ^ self.mask())
+	if n >= len(self.pms) {
+		return core.Tr(fmt.Errorf("Selector %d is out of range of %d pass managers", n, len(self.pms)))
+	}
 	b.Drop(1)
-	return self.pms[n%len(self.pms)].Run(b)
+	return self.pms[n].Run(b)
 }
 
 // Must be noted HTTP codec is special, since it buffers data from reader and writer.
@@ -141,18 +190,13 @@ func (self *HTTPDecoder) Run(b *core.IoVec) error {
 		return core.Tr(err)
 	}
 	defer req.Body.Close()
-	if req.ContentLength <= 0 || req.ContentLength > core.DEFAULT_BUFFER_LIMIT {
+	if req.ContentLength <= 0 || req.ContentLength > DEFAULT_MAX_FRAME_SIZE {
 		err = fmt.Errorf("Content length %d is abnormal", req.ContentLength)
 		return core.Tr(err)
 	}
-	body, err := io.ReadAll(req.Body)
-	if err != nil {
-		return core.Tr(err)
-	}
-	if int64(len(body)) != req.ContentLength {
-		err = fmt.Errorf("Content length %d, %d bytes read in the body", req.ContentLength, len(body))
+	if n, err := readChunks(req.Body, req.ContentLength, b); err != nil {
+		err = fmt.Errorf("Content length %d, %d bytes read in the body: %w", req.ContentLength, n, err)
 		return core.Tr(err)
 	}
-	b.Take(body)
 	return nil
 }
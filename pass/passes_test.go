@@ -1,9 +1,15 @@
 package pass
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"math/rand"
+	"net"
+	"net/http"
 	"testing"
 
 	"github.com/bzEq/bxrx/core"
@@ -22,12 +28,19 @@ func generateRandomSlice(l int) []byte {
 	return buf.Bytes()
 }
 
+const testCodecFrames = 16
+
+// Frames are fed in one segment and in three segments alternately.
 func testCodec(t *testing.T, enc core.Pass, dec core.Pass) {
-	for i := 24; i < 24+8; i++ {
+	for i := 24; i < 24+testCodecFrames; i++ {
 		v := &core.IoVec{}
 		s := generateRandomSlice(i)
 		ss := string(s)
-		v.Take(s)
+		if i%2 == 0 {
+			v.Take(s)
+		} else {
+			v.Take(s[:3]).Take(s[3 : i/2]).Take(s[i/2:])
+		}
 		if err := enc.Run(v); err != nil {
 			t.Fatal(err)
 		}
@@ -55,6 +68,103 @@ func TestOBFS(t *testing.T) {
 	testCodec(t, enc, dec)
 }
 
+func TestFastOBFSIdentical(t *testing.T) {
+	buf := generateRandomSlice(256)
+	for off := 0; off < 8; off++ {
+		for l := 0; l < 128; l++ {
+			s0 := append([]byte{}, buf[off:off+l]...)
+			s1 := append([]byte{}, s0...)
+			// Unaligned in place.
+			byteSwapInPlace(buf[off : off+l])
+			byteSwapInPlaceGo(s1)
+			if !bytes.Equal(buf[off:off+l], s1) {
+				t.Fatalf("Offset %d, length %d", off, l)
+			}
+			byteSwapInPlace(buf[off : off+l])
+			if !bytes.Equal(buf[off:off+l], s0) {
+				t.Fatalf("Offset %d, length %d", off, l)
+			}
+		}
+	}
+	s := []byte("0123456789")
+	byteSwapInPlaceGo(s)
+	if string(s) != "7654321098" {
+		t.Fatal(string(s))
+	}
+}
+
+func benchmarkByteSwap(b *testing.B, f func([]byte), size int) {
+	buf := generateRandomSlice(size + 1)[1:]
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f(buf)
+	}
+}
+
+// Compare with -tags purego or CGO_ENABLED=0 to benchmark the Go implementation
+// as FastOBFS.
+func BenchmarkFastOBFS1K(b *testing.B) {
+	benchmarkByteSwap(b, byteSwapInPlace, 1<<10)
+}
+
+func BenchmarkFastOBFS64K(b *testing.B) {
+	benchmarkByteSwap(b, byteSwapInPlace, 64<<10)
+}
+
+func BenchmarkFastOBFSGo1K(b *testing.B) {
+	benchmarkByteSwap(b, byteSwapInPlaceGo, 1<<10)
+}
+
+func BenchmarkFastOBFSGo64K(b *testing.B) {
+	benchmarkByteSwap(b, byteSwapInPlaceGo, 64<<10)
+}
+
+func TestOBFSSegments(t *testing.T) {
+	for l := 0; l < 40; l++ {
+		s := generateRandomSlice(l)
+		expected := append([]byte{}, s...)
+		byteSwapInPlaceGo(expected)
+		for k := 0; k <= l; k++ {
+			v := core.IoVec{}
+			v.Take(append([]byte{}, s[:k]...)).Take(append([]byte{}, s[k:]...))
+			if err := (&OBFSEncoder{}).Run(&v); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(v.Consume(), expected) {
+				t.Fatalf("Length %d, split at %d", l, k)
+			}
+		}
+	}
+}
+
+// A typical pipeline copies every frame once, i.e., when the frame is sealed.
+func BenchmarkPipeline(b *testing.B) {
+	aead, err := NewAEAD(KeyFromPassphrase("wtf"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	pmb := &core.PackUnpackPassManagerBuilder{}
+	pmb.AddPairedPasses(MustParseSpec("random(pad|obfs, obfs|pad)").Build(nil))
+	pmb.AddPairedPasses(&SeqEncoder{}, &SeqDecoder{})
+	pmb.AddPairedPasses(&AEADEncoder{aead}, &AEADDecoder{aead})
+	pack, unpack := pmb.BuildPackPassManager(), pmb.BuildUnpackPassManager()
+	s := generateRandomSlice(16 << 10)
+	b.SetBytes(int64(len(s)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		v := core.FromSlice(s)
+		if err := pack.Run(v); err != nil {
+			b.Fatal(err)
+		}
+		if err := unpack.Run(v); err != nil {
+			b.Fatal(err)
+		}
+		s = v.Consume()
+	}
+}
+
 func TestHTTP(t *testing.T) {
 	buf := &bytes.Buffer{}
 	enc := NewHTTPEncoder(buf)
@@ -84,3 +194,264 @@ func TestRandomCodec(t *testing.T) {
 	dec.AddPM(decPM1)
 	testCodec(t, enc, dec)
 }
+
+func TestRandomCodecNoPM(t *testing.T) {
+	if err := (&RandomEncoder{}).Run(core.FromSlice([]byte("wtf"))); err == nil {
+		t.Fail()
+	}
+	if err := (&RandomDecoder{}).Run(core.FromSlice([]byte("wtf"))); err == nil {
+		t.Fail()
+	}
+}
+
+func TestRandomCodecWrongKey(t *testing.T) {
+	enc := NewRandomEncoder(KeyFromPassphrase("wtf"))
+	dec := NewRandomDecoder(KeyFromPassphrase("omg"))
+	enc.AddPM(&core.PassManager{})
+	dec.AddPM(&core.PassManager{})
+	// The selector is out of range with probability of 255/256 per frame.
+	failed := false
+	for i := 0; i < 16 && !failed; i++ {
+		v := core.FromSlice([]byte("wtf"))
+		if err := enc.Run(v); err != nil {
+			t.Fatal(err)
+		}
+		failed = dec.Run(v) != nil
+	}
+	if !failed {
+		t.Fail()
+	}
+}
+
+func TestRandomCodecWeights(t *testing.T) {
+	enc := &RandomEncoder{}
+	enc.AddWeightedPM(&core.PassManager{}, 1)
+	enc.AddWeightedPM(core.NewPassManager([]core.Pass{&TailPaddingEncoder{}}), 1000)
+	padded := 0
+	for i := 0; i < 100; i++ {
+		v := core.FromSlice([]byte("wtf"))
+		if err := enc.Run(v); err != nil {
+			t.Fatal(err)
+		}
+		if v.Len() > 4 {
+			padded++
+		}
+	}
+	if padded < 80 {
+		t.Fatal(padded)
+	}
+}
+
+func TestAEAD(t *testing.T) {
+	aead, err := NewAEAD(KeyFromPassphrase("wtf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := &AEADEncoder{aead}
+	dec := &AEADDecoder{aead}
+	testCodec(t, enc, dec)
+}
+
+func TestAEADTampered(t *testing.T) {
+	aead, err := NewAEAD(KeyFromPassphrase("wtf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := &AEADEncoder{aead}
+	dec := &AEADDecoder{aead}
+	v := &core.IoVec{}
+	v.Take(generateRandomSlice(64))
+	if err := enc.Run(v); err != nil {
+		t.Fatal(err)
+	}
+	buf := v.Consume()
+	buf[len(buf)-1] ^= 1
+	v.Take(buf)
+	if err := dec.Run(v); !errors.Is(err, ErrDecryption) {
+		t.Fatal(err)
+	}
+}
+
+func TestAEADWrongKey(t *testing.T) {
+	a0, _ := NewAEAD(KeyFromPassphrase("foo"))
+	a1, _ := NewAEAD(KeyFromPassphrase("bar"))
+	v := &core.IoVec{}
+	v.Take(generateRandomSlice(64))
+	if err := (&AEADEncoder{a0}).Run(v); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&AEADDecoder{a1}).Run(v); !errors.Is(err, ErrDecryption) {
+		t.Fatal(err)
+	}
+}
+
+func TestSeq(t *testing.T) {
+	enc := &SeqEncoder{}
+	dec := &SeqDecoder{}
+	testCodec(t, enc, dec)
+}
+
+func TestSeqReplay(t *testing.T) {
+	enc := &SeqEncoder{}
+	dec := &SeqDecoder{}
+	v := &core.IoVec{}
+	v.Take(generateRandomSlice(32))
+	if err := enc.Run(v); err != nil {
+		t.Fatal(err)
+	}
+	frame := v.Concat()
+	if err := dec.Run(v); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Run(core.FromSlice(frame)); !errors.Is(err, ErrOutOfSequence) {
+		t.Fatal(err)
+	}
+}
+
+func TestFrame(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := NewFrameEncoder(buf)
+	dec := NewFrameDecoder(buf)
+	testCodec(t, enc, dec)
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := NewFrameEncoder(buf)
+	dec := NewFrameDecoder(buf)
+	if err := enc.Run(core.FromSlice(generateRandomSlice(64))); err != nil {
+		t.Fatal(err)
+	}
+	dec.Max = 63
+	if err := dec.Run(&core.IoVec{}); err == nil {
+		t.Fail()
+	}
+	enc.Max = 63
+	if err := enc.Run(core.FromSlice(generateRandomSlice(64))); err == nil {
+		t.Fail()
+	}
+}
+
+func TestFrameReadInChunks(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := NewFrameEncoder(buf)
+	dec := NewFrameDecoder(buf)
+	data := generateRandomSlice(3*READ_CHUNK_SIZE + 1)
+	if err := enc.Run(core.FromSlice(data)); err != nil {
+		t.Fatal(err)
+	}
+	var b core.IoVec
+	if err := dec.Run(&b); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Segments()) != 4 || !bytes.Equal(b.Concat(), data) {
+		t.Fatal(len(b.Segments()))
+	}
+	// A length without its payload fails without taking anything.
+	buf.Write([]byte{0, 0x10, 0, 0, 1})
+	b = core.IoVec{}
+	if err := dec.Run(&b); err == nil || b.Len() != 0 {
+		t.Fatal(err, b.Len())
+	}
+}
+
+func TestHTTPContentLengthTooLarge(t *testing.T) {
+	buf := bytes.NewBufferString(fmt.Sprintf("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: %d\r\n\r\n", DEFAULT_MAX_FRAME_SIZE+1))
+	if err := NewHTTPDecoder(buf).Run(&core.IoVec{}); err == nil {
+		t.Fail()
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+	client := NewWebSocket(c0, false)
+	server := NewWebSocket(c1, true)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < testCodecFrames; i++ {
+			var b core.IoVec
+			if err := server.Decoder().Run(&b); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := server.Encoder().Run(&b); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	testCodec(t, client.Encoder(), client.Decoder())
+	<-done
+}
+
+func TestWebSocketRequest(t *testing.T) {
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+	client := NewWebSocket(c0, false)
+	client.Host = "cdn.example"
+	client.Path = "/ws"
+	go client.handshake()
+	req, err := http.ReadRequest(bufio.NewReader(c1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != "GET" || req.RequestURI != "/ws" || req.Proto != "HTTP/1.1" || req.Host != "cdn.example" {
+		t.Fatal(req.Method, req.RequestURI, req.Proto, req.Host)
+	}
+}
+
+func TestWebSocketControlFrames(t *testing.T) {
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+	client := NewWebSocket(c0, false)
+	server := NewWebSocket(c1, true)
+	pong := make(chan []byte, 1)
+	go func() {
+		if err := client.handshake(); err != nil {
+			t.Error(err)
+			return
+		}
+		go func() {
+			_, op, payload, err := client.readFrame()
+			if err != nil || op != WS_OP_PONG {
+				t.Error(op, err)
+			}
+			pong <- payload.Concat()
+			client.readFrame()
+		}()
+		client.writeFrame(WS_OP_PING, core.FromSlice([]byte("ping")))
+		client.writeFrame(WS_OP_CLOSE, &core.IoVec{})
+	}()
+	var b core.IoVec
+	if err := server.Decoder().Run(&b); !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	if string(<-pong) != "ping" {
+		t.Fail()
+	}
+}
+
+func TestWebSocketMalformedFrames(t *testing.T) {
+	mask := []byte{1, 2, 3, 4}
+	for _, h := range [][]byte{
+		// RSV1 is set.
+		{0xc0 | WS_OP_BINARY, 0x80},
+		// Fragmented ping.
+		{WS_OP_PING, 0x80},
+		// Ping with an extended length.
+		{0x80 | WS_OP_PING, 0x80 | 126, 0, 126},
+	} {
+		c0, c1 := net.Pipe()
+		go c0.Write(append(h, mask...))
+		if _, _, _, err := NewWebSocket(c1, true).readFrame(); err == nil {
+			t.Fatal(h)
+		}
+		c0.Close()
+		c1.Close()
+	}
+}
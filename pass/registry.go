@@ -0,0 +1,63 @@
+// Copyright (c) 2026 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package pass
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/bzEq/bxrx/core"
+)
+
+// Passes may be stateful, so the registry keeps constructors rather than
+// instances.
+type PassFactory func() core.Pass
+
+type registryEntry struct {
+	pack, unpack PassFactory
+}
+
+var registry = struct {
+	mu      sync.RWMutex
+	entries map[string]registryEntry
+}{entries: make(map[string]registryEntry)}
+
+// Register makes a pass pair available to pipeline specs by name. Either of
+// pack and unpack being nil leaves the pass unpaired, which is rejected when a
+// spec uses it.
+func Register(name string, pack, unpack PassFactory) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if _, in := registry.entries[name]; in {
+		panic(fmt.Errorf("Pass %q is registered twice", name))
+	}
+	registry.entries[name] = registryEntry{pack, unpack}
+}
+
+func lookup(name string) (registryEntry, bool) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	e, in := registry.entries[name]
+	return e, in
+}
+
+func RegisteredPasses() []string {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	var names []string
+	for name := range registry.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	Register("pad",
+		func() core.Pass { return &TailPaddingEncoder{} },
+		func() core.Pass { return &TailPaddingDecoder{} })
+	Register("obfs",
+		func() core.Pass { return &OBFSEncoder{} },
+		func() core.Pass { return &OBFSDecoder{} })
+}
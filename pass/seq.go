@@ -0,0 +1,47 @@
+// Copyright (c) 2026 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package pass
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/bzEq/bxrx/core"
+)
+
+// ErrOutOfSequence is returned by SeqDecoder when a frame is replayed, dropped
+// or reordered.
+var ErrOutOfSequence = errors.New("Frame out of sequence")
+
+// SeqEncoder appends a 64-bit sequence number to every frame. It should be
+// run before an AEAD pass so that the sequence number is authenticated.
+type SeqEncoder struct {
+	n uint64
+}
+
+func (self *SeqEncoder) Run(b *core.IoVec) error {
+	var t [8]byte
+	binary.BigEndian.PutUint64(t[:], self.n)
+	self.n++
+	b.Take(t[:])
+	return nil
+}
+
+type SeqDecoder struct {
+	n uint64
+}
+
+func (self *SeqDecoder) Run(b *core.IoVec) error {
+	l := b.Len()
+	if l < 8 {
+		return core.Tr(fmt.Errorf("%w: frame of %d bytes is too short", ErrOutOfSequence, l))
+	}
+	t := b.Split(l - 8)
+	n := binary.BigEndian.Uint64(t.Consume())
+	if n != self.n {
+		return core.Tr(fmt.Errorf("%w: got #%d, expecting #%d", ErrOutOfSequence, n, self.n))
+	}
+	self.n++
+	return nil
+}
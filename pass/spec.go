@@ -0,0 +1,299 @@
+// Copyright (c) 2026 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package pass
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/bzEq/bxrx/core"
+)
+
+// A pipeline spec describes passes run on each frame in packing order, e.g.,
+//
+//	random(pad|obfs, obfs|pad)>http
+//
+//	spec  := seq
+//	seq   := stage { ('>' | '|') stage }
+//	stage := name | 'random' '(' alt { ',' alt } ')'
+//	alt   := seq [ '@' weight ]
+//
+// Both '>' and '|' chain stages. random picks one of its alternatives for
+// every frame, with probability proportional to its weight, 1 by default.
+// The last stage of a spec may name a carrier, which is left to the caller
+// to build.
+type Spec struct {
+	codec   specSeq
+	Carrier string
+}
+
+type specNode interface {
+	build(key []byte) (pack, unpack core.Pass)
+	String() string
+}
+
+type specPass struct {
+	name string
+	registryEntry
+}
+
+func (self *specPass) build(key []byte) (core.Pass, core.Pass) {
+	return self.pack(), self.unpack()
+}
+
+func (self *specPass) String() string {
+	return self.name
+}
+
+type specSeq []specNode
+
+func (self specSeq) buildPM(key []byte) (pack, unpack *core.PassManager) {
+	pmb := &core.PackUnpackPassManagerBuilder{}
+	for _, n := range self {
+		pmb.AddPairedPasses(n.build(key))
+	}
+	return pmb.BuildPackPassManager(), pmb.BuildUnpackPassManager()
+}
+
+func (self specSeq) build(key []byte) (core.Pass, core.Pass) {
+	return self.buildPM(key)
+}
+
+func (self specSeq) String() string {
+	var s []string
+	for _, n := range self {
+		s = append(s, n.String())
+	}
+	return strings.Join(s, "|")
+}
+
+type specAlt struct {
+	seq    specSeq
+	weight int
+}
+
+type specRandom []specAlt
+
+// Every random stage masks its selector with a key of its own.
+func (self specRandom) build(key []byte) (core.Pass, core.Pass) {
+	k := DeriveKey(key, nil, "bxrx "+self.String())
+	enc := NewRandomEncoder(k)
+	dec := NewRandomDecoder(k)
+	for _, alt := range self {
+		pack, unpack := alt.seq.buildPM(key)
+		enc.AddWeightedPM(pack, alt.weight)
+		dec.AddPM(unpack)
+	}
+	return enc, dec
+}
+
+func (self specRandom) String() string {
+	var s []string
+	for _, alt := range self {
+		if alt.weight == 1 {
+			s = append(s, alt.seq.String())
+		} else {
+			s = append(s, fmt.Sprintf("%s@%d", alt.seq, alt.weight))
+		}
+	}
+	return "random(" + strings.Join(s, ",") + ")"
+}
+
+// Build creates fresh pack and unpack pass managers of the codec, i.e., all
+// stages except the carrier. Peers must build with the same key, which keys
+// passes like random.
+func (self *Spec) Build(key []byte) (pack, unpack *core.PassManager) {
+	return self.codec.buildPM(key)
+}
+
+// String returns the canonical form of the spec, which is identical for specs
+// building identical pipelines.
+func (self *Spec) String() string {
+	s := self.codec.String()
+	if self.Carrier == "" {
+		return s
+	}
+	if s == "" {
+		return self.Carrier
+	}
+	return s + ">" + self.Carrier
+}
+
+type specParser struct {
+	s        string
+	pos      int
+	carriers map[string]bool
+}
+
+func (self *specParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Invalid pipeline spec %q at offset %d: %s", self.s, self.pos, fmt.Sprintf(format, args...))
+}
+
+func (self *specParser) skipSpaces() {
+	for self.pos < len(self.s) && unicode.IsSpace(rune(self.s[self.pos])) {
+		self.pos++
+	}
+}
+
+func (self *specParser) peek() byte {
+	self.skipSpaces()
+	if self.pos >= len(self.s) {
+		return 0
+	}
+	return self.s[self.pos]
+}
+
+func (self *specParser) expect(c byte) error {
+	if self.peek() != c {
+		return self.errorf("expecting %q", c)
+	}
+	self.pos++
+	return nil
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || c == '-' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+func (self *specParser) name() string {
+	self.skipSpaces()
+	start := self.pos
+	for self.pos < len(self.s) && isNameByte(self.s[self.pos]) {
+		self.pos++
+	}
+	return self.s[start:self.pos]
+}
+
+const MAX_RANDOM_WEIGHT = 1 << 16
+
+func (self *specParser) weight() (int, error) {
+	self.skipSpaces()
+	start := self.pos
+	for self.pos < len(self.s) && '0' <= self.s[self.pos] && self.s[self.pos] <= '9' {
+		self.pos++
+	}
+	w, err := strconv.Atoi(self.s[start:self.pos])
+	if err != nil || w <= 0 || w > MAX_RANDOM_WEIGHT {
+		self.pos = start
+		return 0, self.errorf("weight must be an integer from 1 to %d", MAX_RANDOM_WEIGHT)
+	}
+	return w, nil
+}
+
+// Returns the carrier if the stage is a carrier.
+func (self *specParser) stage() (specNode, string, error) {
+	start := self.pos
+	name := self.name()
+	if name == "" {
+		return nil, "", self.errorf("expecting a pass")
+	}
+	if name == "random" && self.peek() == '(' {
+		self.pos++
+		var r specRandom
+		for {
+			seq, carrier, err := self.seq()
+			if err != nil {
+				return nil, "", err
+			}
+			if carrier != "" {
+				return nil, "", self.errorf("carrier %q must be the last stage", carrier)
+			}
+			if len(seq) == 0 {
+				return nil, "", self.errorf("empty alternative of random")
+			}
+			weight := 1
+			if self.peek() == '@' {
+				self.pos++
+				if weight, err = self.weight(); err != nil {
+					return nil, "", err
+				}
+			}
+			r = append(r, specAlt{seq, weight})
+			if self.peek() != ',' {
+				break
+			}
+			self.pos++
+		}
+		if len(r) > 256 {
+			return nil, "", self.errorf("random has %d alternatives, at most 256 are allowed", len(r))
+		}
+		return r, "", self.expect(')')
+	}
+	if self.carriers[name] {
+		return nil, name, nil
+	}
+	e, in := lookup(name)
+	if !in {
+		self.pos = start
+		return nil, "", self.errorf("unknown pass %q, available passes are %s and carriers are %s",
+			name, strings.Join(RegisteredPasses(), ", "), strings.Join(self.carrierNames(), ", "))
+	}
+	if e.pack == nil || e.unpack == nil {
+		self.pos = start
+		return nil, "", self.errorf("pass %q is unpaired", name)
+	}
+	return &specPass{name, e}, "", nil
+}
+
+func (self *specParser) carrierNames() []string {
+	var names []string
+	for name := range self.carriers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (self *specParser) seq() (seq specSeq, carrier string, err error) {
+	for {
+		var n specNode
+		var c string
+		n, c, err = self.stage()
+		if err != nil {
+			return
+		}
+		if carrier != "" {
+			err = self.errorf("carrier %q must be the last stage", carrier)
+			return
+		}
+		if c != "" {
+			carrier = c
+		} else {
+			seq = append(seq, n)
+		}
+		switch self.peek() {
+		case '>', '|':
+			self.pos++
+		default:
+			return
+		}
+	}
+}
+
+// ParseSpec parses and validates a pipeline spec. Names in carriers are
+// accepted as the last stage.
+func ParseSpec(s string, carriers ...string) (*Spec, error) {
+	p := &specParser{s: s, carriers: make(map[string]bool)}
+	for _, c := range carriers {
+		p.carriers[c] = true
+	}
+	seq, carrier, err := p.seq()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != 0 {
+		return nil, p.errorf("unexpected %q", p.s[p.pos])
+	}
+	return &Spec{seq, carrier}, nil
+}
+
+func MustParseSpec(s string, carriers ...string) *Spec {
+	spec, err := ParseSpec(s, carriers...)
+	if err != nil {
+		panic(err)
+	}
+	return spec
+}
@@ -0,0 +1,72 @@
+package pass
+
+import (
+	"testing"
+
+	"github.com/bzEq/bxrx/core"
+)
+
+func TestParseSpec(t *testing.T) {
+	spec, err := ParseSpec(" random( pad | obfs , obfs>pad ) > http ", "http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Carrier != "http" {
+		t.Fail()
+	}
+	if spec.String() != "random(pad|obfs,obfs|pad)>http" {
+		t.Log(spec.String())
+		t.Fail()
+	}
+	enc, dec := spec.Build(KeyFromPassphrase("wtf"))
+	testCodec(t, enc, dec)
+}
+
+func TestParseSpecWithoutCarrier(t *testing.T) {
+	spec, err := ParseSpec("pad>obfs>random(pad,obfs)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Carrier != "" {
+		t.Fail()
+	}
+	enc, dec := spec.Build(KeyFromPassphrase("wtf"))
+	testCodec(t, enc, dec)
+}
+
+func TestParseSpecErrors(t *testing.T) {
+	if _, in := lookup("half"); !in {
+		Register("half", func() core.Pass { return &OBFSEncoder{} }, nil)
+	}
+	for _, s := range []string{
+		"",
+		"foo",
+		"pad|",
+		"random()",
+		"random(pad",
+		"random(pad,http)",
+		"random(pad@0,obfs)",
+		"random(pad@x)",
+		"random(pad@65537)",
+		"http>pad",
+		"half",
+		"pad)",
+	} {
+		if _, err := ParseSpec(s, "http"); err == nil {
+			t.Errorf("%q should be rejected", s)
+		}
+	}
+}
+
+func TestParseSpecWeights(t *testing.T) {
+	spec, err := ParseSpec("random(pad|obfs @3, obfs@1, random(pad, obfs@2)@ 2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.String() != "random(pad|obfs@3,obfs,random(pad,obfs@2)@2)" {
+		t.Log(spec.String())
+		t.Fail()
+	}
+	enc, dec := spec.Build(KeyFromPassphrase("wtf"))
+	testCodec(t, enc, dec)
+}
@@ -0,0 +1,328 @@
+// Copyright (c) 2026 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package pass
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/bzEq/bxrx/core"
+)
+
+const (
+	WS_OP_CONTINUATION = 0x0
+	WS_OP_TEXT         = 0x1
+	WS_OP_BINARY       = 0x2
+	WS_OP_CLOSE        = 0x8
+	WS_OP_PING         = 0x9
+	WS_OP_PONG         = 0xa
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func headerContains(h http.Header, k, v string) bool {
+	for _, s := range h.Values(k) {
+		for _, t := range strings.Split(s, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WebSocket is the state shared by WebSocketEncoder and WebSocketDecoder of a
+// connection. The RFC 6455 opening handshake is performed by whichever of
+// them runs first. Every packed IoVec is carried as a binary message.
+type WebSocket struct {
+	conn   net.Conn
+	rbuf   *bufio.Reader
+	server bool
+	// The request line and the Host header sent by clients, which CDNs and
+	// reverse proxies route on. Host is the remote address if empty.
+	Path string
+	Host string
+	once sync.Once
+	err  error
+	// Serializes frames written by the encoder and control frames replied by
+	// the decoder.
+	wmu    sync.Mutex
+	closed bool
+}
+
+func NewWebSocket(c net.Conn, server bool) *WebSocket {
+	return &WebSocket{
+		conn:   c,
+		rbuf:   bufio.NewReader(c),
+		server: server,
+		Path:   "/",
+	}
+}
+
+func (self *WebSocket) Encoder() *WebSocketEncoder {
+	return &WebSocketEncoder{self}
+}
+
+func (self *WebSocket) Decoder() *WebSocketDecoder {
+	return &WebSocketDecoder{self}
+}
+
+func (self *WebSocket) handshake() error {
+	self.once.Do(func() {
+		if self.server {
+			self.err = self.accept()
+		} else {
+			self.err = self.dial()
+		}
+	})
+	return self.err
+}
+
+func (self *WebSocket) dial() error {
+	var nonce [16]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return core.Tr(err)
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req, err := http.NewRequest("GET", self.Path, nil)
+	if err != nil {
+		return core.Tr(err)
+	}
+	req.Host = self.Host
+	if req.Host == "" {
+		req.Host = self.conn.RemoteAddr().String()
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(self.conn); err != nil {
+		return core.Tr(err)
+	}
+	resp, err := http.ReadResponse(self.rbuf, req)
+	if err != nil {
+		return core.Tr(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return core.Tr(fmt.Errorf("WebSocket upgrade failed: %s", resp.Status))
+	}
+	if !headerContains(resp.Header, "Upgrade", "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		return core.Tr(fmt.Errorf("Invalid WebSocket upgrade response"))
+	}
+	return nil
+}
+
+func (self *WebSocket) accept() error {
+	req, err := http.ReadRequest(self.rbuf)
+	if err != nil {
+		return core.Tr(err)
+	}
+	req.Body.Close()
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != "GET" ||
+		!headerContains(req.Header, "Connection", "upgrade") ||
+		!headerContains(req.Header, "Upgrade", "websocket") ||
+		req.Header.Get("Sec-WebSocket-Version") != "13" ||
+		key == "" {
+		resp := http.Response{
+			Status:     "400 Bad Request",
+			StatusCode: http.StatusBadRequest,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+		}
+		resp.Write(self.conn)
+		return core.Tr(fmt.Errorf("Invalid WebSocket upgrade request"))
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n"
+	_, err = io.WriteString(self.conn, resp)
+	return core.Tr(err)
+}
+
+// Masks a frame in place, segment by segment.
+type wsMask [4]byte
+
+func (self *wsMask) Run(b *core.IoVec) error {
+	return core.RunSegments(self, b)
+}
+
+func (self *wsMask) RunSegment(offset int, seg []byte) {
+	for i := range seg {
+		seg[i] ^= self[(offset+i)%4]
+	}
+}
+
+// Clients must mask their frames, servers must not. payload is consumed.
+func (self *WebSocket) writeFrame(op byte, payload *core.IoVec) error {
+	self.wmu.Lock()
+	defer self.wmu.Unlock()
+	if self.closed {
+		return core.Tr(net.ErrClosed)
+	}
+	if op == WS_OP_CLOSE {
+		self.closed = true
+	}
+	h := make([]byte, 2, 14)
+	h[0] = 0x80 | op
+	l := payload.Len()
+	switch {
+	case l < 126:
+		h[1] = byte(l)
+	case l <= 0xffff:
+		h[1] = 126
+		h = binary.BigEndian.AppendUint16(h, uint16(l))
+	default:
+		h[1] = 127
+		h = binary.BigEndian.AppendUint64(h, uint64(l))
+	}
+	if !self.server {
+		h[1] |= 0x80
+		var mask wsMask
+		if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+			return core.Tr(err)
+		}
+		h = append(h, mask[:]...)
+		mask.Run(payload)
+	}
+	payload.Prepend(h)
+	_, err := payload.WriteTo(self.conn)
+	return core.Tr(err)
+}
+
+// The payload is read in chunks as it arrives.
+func (self *WebSocket) readFrame() (fin bool, op byte, payload *core.IoVec, err error) {
+	var h [8]byte
+	if _, err = io.ReadFull(self.rbuf, h[:2]); err != nil {
+		err = core.Tr(err)
+		return
+	}
+	fin = h[0]&0x80 != 0
+	op = h[0] & 0x0f
+	// No extension is negotiated, so RSV bits must be clear.
+	if h[0]&0x70 != 0 {
+		err = core.Tr(fmt.Errorf("WebSocket frame has RSV bits set"))
+		return
+	}
+	masked := h[1]&0x80 != 0
+	if masked != self.server {
+		err = core.Tr(fmt.Errorf("WebSocket frame masking violates RFC 6455"))
+		return
+	}
+	l := uint64(h[1] & 0x7f)
+	// Control frames must not be fragmented and their payload must not exceed
+	// 125 bytes, i.e., no extended length is used.
+	if op&0x08 != 0 && (!fin || l > 125) {
+		err = core.Tr(fmt.Errorf("WebSocket control frame %d is fragmented or too long", op))
+		return
+	}
+	switch l {
+	case 126:
+		if _, err = io.ReadFull(self.rbuf, h[:2]); err != nil {
+			err = core.Tr(err)
+			return
+		}
+		l = uint64(binary.BigEndian.Uint16(h[:2]))
+	case 127:
+		if _, err = io.ReadFull(self.rbuf, h[:8]); err != nil {
+			err = core.Tr(err)
+			return
+		}
+		l = binary.BigEndian.Uint64(h[:8])
+	}
+	if l > DEFAULT_MAX_FRAME_SIZE {
+		err = core.Tr(fmt.Errorf("WebSocket frame length %d exceeds limit %d", l, DEFAULT_MAX_FRAME_SIZE))
+		return
+	}
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(self.rbuf, mask[:]); err != nil {
+			err = core.Tr(err)
+			return
+		}
+	}
+	payload = &core.IoVec{}
+	if _, err = readChunks(self.rbuf, int64(l), payload); err != nil {
+		err = core.Tr(err)
+		return
+	}
+	if masked {
+		(*wsMask)(&mask).Run(payload)
+	}
+	return
+}
+
+type WebSocketEncoder struct {
+	*WebSocket
+}
+
+func (self *WebSocketEncoder) Run(b *core.IoVec) error {
+	if err := self.handshake(); err != nil {
+		return core.Tr(err)
+	}
+	return self.writeFrame(WS_OP_BINARY, b)
+}
+
+type WebSocketDecoder struct {
+	*WebSocket
+}
+
+// Control frames are handled in place, pings are answered and a close frame
+// is echoed and reported as io.EOF.
+func (self *WebSocketDecoder) Run(b *core.IoVec) error {
+	if err := self.handshake(); err != nil {
+		return core.Tr(err)
+	}
+	var msg core.IoVec
+	started := false
+	for {
+		fin, op, payload, err := self.readFrame()
+		if err != nil {
+			return core.Tr(err)
+		}
+		switch op {
+		case WS_OP_PING:
+			if err := self.writeFrame(WS_OP_PONG, payload); err != nil {
+				return core.Tr(err)
+			}
+		case WS_OP_PONG:
+		case WS_OP_CLOSE:
+			self.writeFrame(WS_OP_CLOSE, payload)
+			return core.Tr(io.EOF)
+		case WS_OP_BINARY, WS_OP_CONTINUATION:
+			if (op == WS_OP_BINARY) == started {
+				return core.Tr(fmt.Errorf("Unexpected WebSocket opcode %d", op))
+			}
+			started = true
+			msg.Append(payload)
+			if msg.Len() > DEFAULT_MAX_FRAME_SIZE {
+				return core.Tr(fmt.Errorf("WebSocket message exceeds limit %d", DEFAULT_MAX_FRAME_SIZE))
+			}
+			if fin {
+				b.Append(&msg)
+				return nil
+			}
+		default:
+			return core.Tr(fmt.Errorf("Unexpected WebSocket opcode %d", op))
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package http
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"time"
+
+	"github.com/bzEq/bxrx/core"
 )
 
 // See https://www.rfc-editor.org/rfc/rfc9110.html#field.connection
@@ -18,6 +22,9 @@ var HopByHopFields = []string{
 	"Upgrade",
 }
 
+// Seconds to write the response of CONNECT.
+const REPLY_TIMEOUT = 8
+
 func RemoveHopByHopFields(header http.Header) {
 	for _, f := range HopByHopFields {
 		header.Del(f)
@@ -26,11 +33,28 @@ func RemoveHopByHopFields(header http.Header) {
 
 type HTTPProxy struct {
 	Transport http.RoundTripper
-	Relay     func(c net.Conn, raddr string)
+	// Relay relays c to raddr, calling reply once dialing raddr resolves.
+	Relay func(c net.Conn, raddr string, reply func(err error) error)
 }
 
+// StatusOfDialError returns 504 if dialing the destination timed out,
+// otherwise 502, e.g., for errors of the tunnel.
+func StatusOfDialError(err error) int {
+	var de *core.DialError
+	if errors.As(err, &de) && de.Class == core.DIAL_ERROR_TIMEOUT {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// The response is written once the tunnel is dialed, so the connection is
+// hijacked before any response is written.
 func (self *HTTPProxy) handleConnect(w http.ResponseWriter, req *http.Request) {
-	w.WriteHeader(http.StatusOK)
+	if self.Relay == nil {
+		log.Println("Nil relay function, failed relaying to", req.Host)
+		http.Error(w, "Relaying not supported", http.StatusInternalServerError)
+		return
+	}
 	h, ok := w.(http.Hijacker)
 	if !ok {
 		log.Println(fmt.Errorf("Hijacking not supported"))
@@ -43,11 +67,17 @@ func (self *HTTPProxy) handleConnect(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
-	if self.Relay == nil {
-		log.Println("Nil relay function, failed relaying to", req.Host)
-		return
-	}
-	self.Relay(c, req.Host)
+	self.Relay(c, req.Host, func(err error) error {
+		resp := "HTTP/1.1 200 Connection established\r\n\r\n"
+		if err != nil {
+			status := StatusOfDialError(err)
+			resp = fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+		}
+		c.SetWriteDeadline(time.Now().Add(REPLY_TIMEOUT * time.Second))
+		_, werr := io.WriteString(c, resp)
+		c.SetWriteDeadline(time.Time{})
+		return werr
+	})
 }
 
 func copyHeader(dst, src http.Header) {
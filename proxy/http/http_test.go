@@ -0,0 +1,61 @@
+package http
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/bzEq/bxrx/core"
+)
+
+func TestStatusOfDialError(t *testing.T) {
+	if s := StatusOfDialError(core.NewDialError("a:1", syscall.ECONNREFUSED)); s != http.StatusBadGateway {
+		t.Fatal(s)
+	}
+	if s := StatusOfDialError(core.NewDialError("a:1", &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded})); s != http.StatusGatewayTimeout {
+		t.Fatal(s)
+	}
+	// Timeouts of the tunnel are not of the destination.
+	if s := StatusOfDialError(&net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}); s != http.StatusBadGateway {
+		t.Fatal(s)
+	}
+}
+
+func TestConnectReply(t *testing.T) {
+	proxy := &HTTPProxy{
+		Relay: func(c net.Conn, raddr string, reply func(error) error) {
+			defer c.Close()
+			if raddr == "refused.example:443" {
+				reply(syscall.ECONNREFUSED)
+			} else {
+				reply(nil)
+			}
+		},
+	}
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	for host, status := range map[string]int{"refused.example:443": http.StatusBadGateway, "example.com:443": http.StatusOK} {
+		c, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest(http.MethodConnect, "http://"+host, nil)
+		req.Host = host
+		if err := req.Write(c); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(c), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != status {
+			t.Fatal(host, resp.StatusCode)
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright (c) 2026 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package http
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bzEq/bxrx/core"
+)
+
+// A tunnel carries a byte stream by genuine HTTP exchanges, so it survives
+// reverse proxies and other HTTP intermediaries.
+//  - POST ?s=<session> sends the request body upstream, an empty POST opens
+//    the session.
+//  - GET ?s=<session> is long-polled for downstream bytes. 200 carries bytes,
+//    204 means nothing arrived within the poll timeout, 410 means the session
+//    is closed.
+//  - DELETE ?s=<session> closes the session.
+
+const DEFAULT_TUNNEL_POLL_TIMEOUT = 25
+const DEFAULT_TUNNEL_CHUNK_SIZE = 64 << 10
+const DEFAULT_TUNNEL_BACKLOG = 128
+const DEFAULT_TUNNEL_MAX_SESSIONS = 1024
+
+// Sessions neither posted to nor polled for this many poll timeouts are
+// closed, since clients might vanish without DELETE.
+const DEFAULT_TUNNEL_IDLE_POLLS = 4
+
+type tunnelAddr string
+
+func (self tunnelAddr) Network() string { return "http" }
+
+func (self tunnelAddr) String() string { return string(self) }
+
+// One end of a net.Pipe, the other end is driven by HTTP requests.
+type tunnelConn struct {
+	net.Conn
+	laddr, raddr net.Addr
+	onClose      func()
+	once         sync.Once
+}
+
+func (self *tunnelConn) LocalAddr() net.Addr {
+	return self.laddr
+}
+
+func (self *tunnelConn) RemoteAddr() net.Addr {
+	return self.raddr
+}
+
+func (self *tunnelConn) Close() error {
+	self.once.Do(self.onClose)
+	return self.Conn.Close()
+}
+
+// TunnelServer is both the http.Handler serving tunnels and the net.Listener
+// accepting them. It can be mounted behind any reverse proxy.
+type TunnelServer struct {
+	PollTimeout time.Duration
+	// DEFAULT_TUNNEL_IDLE_POLLS poll timeouts if zero.
+	IdleTimeout time.Duration
+	// New sessions are refused beyond this many.
+	MaxSessions int
+	addr        net.Addr
+	sessions    core.Map[string, *tunnelSession]
+	// Number of sessions, including those being opened.
+	n         int32
+	ch        chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type tunnelSession struct {
+	remote net.Conn
+	idle   *time.Timer
+}
+
+func NewTunnelServer(addr net.Addr) *TunnelServer {
+	return &TunnelServer{
+		PollTimeout: DEFAULT_TUNNEL_POLL_TIMEOUT * time.Second,
+		MaxSessions: DEFAULT_TUNNEL_MAX_SESSIONS,
+		addr:        addr,
+		ch:          make(chan net.Conn, DEFAULT_TUNNEL_BACKLOG),
+		done:        make(chan struct{}),
+	}
+}
+
+func (self *TunnelServer) idleTimeout() time.Duration {
+	if self.IdleTimeout > 0 {
+		return self.IdleTimeout
+	}
+	return DEFAULT_TUNNEL_IDLE_POLLS * self.PollTimeout
+}
+
+// Returns false if s was removed already.
+func (self *TunnelServer) remove(sid string, s *tunnelSession) bool {
+	if !self.sessions.CompareAndDelete(sid, s) {
+		return false
+	}
+	s.idle.Stop()
+	atomic.AddInt32(&self.n, -1)
+	return true
+}
+
+func (self *TunnelServer) Accept() (net.Conn, error) {
+	select {
+	case c := <-self.ch:
+		return c, nil
+	case <-self.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (self *TunnelServer) Close() error {
+	self.closeOnce.Do(func() { close(self.done) })
+	return nil
+}
+
+func (self *TunnelServer) Addr() net.Addr {
+	return self.addr
+}
+
+func (self *TunnelServer) open(sid string, req *http.Request) (*tunnelSession, error) {
+	if atomic.AddInt32(&self.n, 1) > int32(self.MaxSessions) {
+		atomic.AddInt32(&self.n, -1)
+		return nil, fmt.Errorf("Too many tunnel sessions, refusing %s", req.RemoteAddr)
+	}
+	local, remote := net.Pipe()
+	s := &tunnelSession{remote: remote}
+	s.idle = time.AfterFunc(self.idleTimeout(), func() {
+		if self.remove(sid, s) {
+			log.Println("Tunnel session of", req.RemoteAddr, "is idle, closing it")
+			remote.Close()
+		}
+	})
+	if r, in := self.sessions.LoadOrStore(sid, s); in {
+		s.idle.Stop()
+		atomic.AddInt32(&self.n, -1)
+		return r, nil
+	}
+	c := &tunnelConn{
+		Conn:  local,
+		laddr: self.addr,
+		raddr: tunnelAddr(req.RemoteAddr),
+		onClose: func() {
+			self.remove(sid, s)
+		},
+	}
+	select {
+	case self.ch <- c:
+		return s, nil
+	case <-self.done:
+		c.Close()
+		return nil, net.ErrClosed
+	}
+}
+
+func (self *TunnelServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	sid := req.URL.Query().Get("s")
+	if len(sid) == 0 {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	s, in := self.sessions.Load(sid)
+	if in {
+		// Requests last up to a poll timeout, so sessions are touched again
+		// once they are served.
+		s.idle.Reset(self.idleTimeout())
+		defer s.idle.Reset(self.idleTimeout())
+	}
+	switch req.Method {
+	case http.MethodPost:
+		if !in {
+			var err error
+			if s, err = self.open(sid, req); err != nil {
+				log.Println(err)
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			defer s.idle.Reset(self.idleTimeout())
+		}
+		if _, err := io.Copy(s.remote, req.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		if !in {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		buf := make([]byte, DEFAULT_TUNNEL_CHUNK_SIZE)
+		s.remote.SetReadDeadline(time.Now().Add(self.PollTimeout))
+		n, err := s.remote.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				w.WriteHeader(http.StatusNoContent)
+			} else {
+				http.Error(w, err.Error(), http.StatusGone)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(buf[:n])
+	case http.MethodDelete:
+		if in {
+			s.remote.Close()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// TunnelClient dials tunnels served by TunnelServer at Path of the address.
+type TunnelClient struct {
+	Client *http.Client
+	Path   string
+}
+
+func (self *TunnelClient) do(method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	return self.Client.Do(req)
+}
+
+func (self *TunnelClient) Dial(network, addr string) (net.Conn, error) {
+	var id [16]byte
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		return nil, err
+	}
+	url := "http://" + addr + self.Path + "?s=" + hex.EncodeToString(id[:])
+	resp, err := self.do(http.MethodPost, url, []byte{})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("Opening tunnel to %s failed: %s", url, resp.Status)
+	}
+	local, remote := net.Pipe()
+	go self.upstream(url, remote)
+	go self.downstream(url, remote)
+	c := &tunnelConn{
+		Conn:    local,
+		laddr:   tunnelAddr("local"),
+		raddr:   tunnelAddr(addr),
+		onClose: func() {},
+	}
+	return c, nil
+}
+
+func (self *TunnelClient) upstream(url string, remote net.Conn) {
+	defer remote.Close()
+	buf := make([]byte, DEFAULT_TUNNEL_CHUNK_SIZE)
+	for {
+		n, err := remote.Read(buf)
+		if err != nil {
+			if resp, err := self.do(http.MethodDelete, url, nil); err == nil {
+				resp.Body.Close()
+			}
+			return
+		}
+		resp, err := self.do(http.MethodPost, url, buf[:n])
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			log.Println("Tunnel", url, "is broken:", resp.Status)
+			return
+		}
+	}
+}
+
+func (self *TunnelClient) downstream(url string, remote net.Conn) {
+	defer remote.Close()
+	for {
+		resp, err := self.do(http.MethodGet, url, nil)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			_, err = io.Copy(remote, resp.Body)
+		case http.StatusNoContent:
+		default:
+			err = fmt.Errorf("Tunnel %s is closed: %s", url, resp.Status)
+		}
+		resp.Body.Close()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTunnel(t *testing.T) {
+	ts := NewTunnelServer(nil)
+	server := httptest.NewServer(ts)
+	defer server.Close()
+	client := &TunnelClient{
+		Client: &http.Client{},
+		Path:   "/",
+	}
+	c, err := client.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ts.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(s, buf); err != nil {
+			t.Error(err)
+			return
+		}
+		s.Write([]byte(strings.ToUpper(string(buf))))
+		s.Close()
+	}()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "HELLO" {
+		t.Fail()
+	}
+	c.Close()
+}
+
+func TestTunnelNotFound(t *testing.T) {
+	server := httptest.NewServer(NewTunnelServer(nil))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/?s=wtf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fail()
+	}
+}
+
+func TestTunnelIdleSession(t *testing.T) {
+	ts := NewTunnelServer(nil)
+	ts.IdleTimeout = 50 * time.Millisecond
+	server := httptest.NewServer(ts)
+	defer server.Close()
+	resp, err := http.Post(server.URL+"/?s=idle", "application/octet-stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	c, err := ts.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// The session is closed once it expires, without DELETE.
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	if _, in := ts.sessions.Load("idle"); in || atomic.LoadInt32(&ts.n) != 0 {
+		t.Fatal("Idle session isn't removed")
+	}
+}
+
+func TestTunnelMaxSessions(t *testing.T) {
+	ts := NewTunnelServer(nil)
+	ts.MaxSessions = 1
+	server := httptest.NewServer(ts)
+	defer server.Close()
+	for sid, status := range []int{http.StatusNoContent, http.StatusServiceUnavailable} {
+		resp, err := http.Post(fmt.Sprintf("%s/?s=%d", server.URL, sid), "application/octet-stream", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatal(sid, resp.StatusCode)
+		}
+	}
+	c, err := ts.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	resp, err := http.Post(server.URL+"/?s=2", "application/octet-stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatal(resp.StatusCode)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2026 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package socks5
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bzEq/bxrx/core"
+)
+
+// See https://www.rfc-editor.org/rfc/rfc1929.
+const AUTH_VER = 1
+
+const (
+	AUTH_SUCC    = 0
+	AUTH_FAILURE = 1
+)
+
+// Credentials of users, e.g., loaded from a file of "username:password"
+// lines. Empty lines and lines starting with '#' are ignored.
+type Credentials struct {
+	passwords map[string]string
+	// In order of being added.
+	users []string
+}
+
+func NewCredentials() *Credentials {
+	return &Credentials{passwords: make(map[string]string)}
+}
+
+func (self *Credentials) Add(user, password string) error {
+	if len(user) == 0 || len(user) > 255 || len(password) == 0 || len(password) > 255 {
+		return fmt.Errorf("Username and password must have 1 to 255 bytes")
+	}
+	if _, in := self.passwords[user]; in {
+		return fmt.Errorf("User %s already exists", user)
+	}
+	self.passwords[user] = password
+	self.users = append(self.users, user)
+	return nil
+}
+
+func ParseCredentials(r io.Reader) (*Credentials, error) {
+	creds := NewCredentials()
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, password, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("Line %d: expecting username:password", n)
+		}
+		if err := creds.Add(user, password); err != nil {
+			return nil, fmt.Errorf("Line %d: %w", n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(creds.users) == 0 {
+		return nil, fmt.Errorf("No credentials")
+	}
+	return creds, nil
+}
+
+func LoadCredentials(path string) (*Credentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	creds, err := ParseCredentials(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return creds, nil
+}
+
+// Passwords are compared in constant time.
+func (self *Credentials) Verify(user, password string) bool {
+	expected, in := self.passwords[user]
+	if !in {
+		// Take the same time as a wrong password.
+		expected = password
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1 && in
+}
+
+// First returns the first user added, e.g., for local clients.
+func (self *Credentials) First() (user, password string) {
+	user = self.users[0]
+	return user, self.passwords[user]
+}
+
+// Read
+// +----+------+----------+------+----------+
+// |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+// +----+------+----------+------+----------+
+// | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+// +----+------+----------+------+----------+
+// Write
+// +----+--------+
+// |VER | STATUS |
+// +----+--------+
+// | 1  |   1    |
+// +----+--------+
+func Authenticate(rw net.Conn, creds *Credentials) (user string, err error) {
+	buf := make([]byte, 256)
+	rw.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT * time.Second))
+	if _, err = io.ReadFull(rw, buf[:2]); err != nil {
+		err = core.Tr(fmt.Errorf("Reading VER, ULEN failed: %w", err))
+		return
+	}
+	if buf[0] != AUTH_VER {
+		err = core.Tr(fmt.Errorf("Unsupported auth VER: %d", buf[0]))
+		return
+	}
+	// UNAME and PLEN.
+	ulen := int(buf[1])
+	rw.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT * time.Second))
+	if _, err = io.ReadFull(rw, buf[:ulen+1]); err != nil {
+		err = core.Tr(fmt.Errorf("Reading UNAME failed: %w", err))
+		return
+	}
+	name := string(buf[:ulen])
+	plen := int(buf[ulen])
+	rw.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT * time.Second))
+	if _, err = io.ReadFull(rw, buf[:plen]); err != nil {
+		err = core.Tr(fmt.Errorf("Reading PASSWD failed: %w", err))
+		return
+	}
+	var status byte = AUTH_SUCC
+	if !creds.Verify(name, string(buf[:plen])) {
+		status = AUTH_FAILURE
+	}
+	rw.SetWriteDeadline(time.Now().Add(HANDSHAKE_TIMEOUT * time.Second))
+	if _, err = rw.Write([]byte{AUTH_VER, status}); err != nil {
+		err = core.Tr(fmt.Errorf("Writing STATUS failed: %w", err))
+		return
+	}
+	if status != AUTH_SUCC {
+		err = core.Tr(fmt.Errorf("Authentication of user %q failed", name))
+		return
+	}
+	return name, nil
+}
@@ -3,6 +3,7 @@ package socks5
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -59,6 +60,12 @@ type UDPRequest struct {
 	DATA       []byte
 }
 
+const (
+	METHOD_NO_AUTH           = 0
+	METHOD_USERNAME_PASSWORD = 2
+	METHOD_NO_ACCEPTABLE     = 0xff
+)
+
 const HANDSHAKE_TIMEOUT = 8
 
 // Read
@@ -73,7 +80,11 @@ const HANDSHAKE_TIMEOUT = 8
 // +----+--------+
 // | 1  |   1    |
 // +----+--------+
-func ExchangeMetadata(rw net.Conn) (err error) {
+// Without credentials METHOD_NO_AUTH is required, otherwise
+// METHOD_USERNAME_PASSWORD is required and the username authenticated is
+// returned. METHOD_NO_ACCEPTABLE is answered if the required one is not
+// offered.
+func ExchangeMetadata(rw net.Conn, creds *Credentials) (user string, err error) {
 	buf := make([]byte, 255)
 	// VER, NMETHODS.
 	rw.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT * time.Second))
@@ -81,6 +92,10 @@ func ExchangeMetadata(rw net.Conn) (err error) {
 		err = core.Tr(fmt.Errorf("Reading VER, NMETHODS failed: %w", err))
 		return
 	}
+	if buf[0] != VER {
+		err = core.Tr(fmt.Errorf("Unsupported VER: %d", buf[0]))
+		return
+	}
 	// METHODS.
 	methods := buf[1]
 	rw.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT * time.Second))
@@ -88,12 +103,24 @@ func ExchangeMetadata(rw net.Conn) (err error) {
 		err = core.Tr(fmt.Errorf("Reading METHODS failed: %w", err))
 		return
 	}
-	// No auth for now.
+	var method byte = METHOD_NO_AUTH
+	if creds != nil {
+		method = METHOD_USERNAME_PASSWORD
+	}
+	if bytes.IndexByte(buf[:methods], method) < 0 {
+		method = METHOD_NO_ACCEPTABLE
+	}
 	rw.SetWriteDeadline(time.Now().Add(HANDSHAKE_TIMEOUT * time.Second))
-	if _, err = rw.Write([]byte{VER, 0}); err != nil {
+	if _, err = rw.Write([]byte{VER, method}); err != nil {
 		err = core.Tr(fmt.Errorf("Writing VER failed: %w", err))
 		return
 	}
+	switch method {
+	case METHOD_NO_ACCEPTABLE:
+		err = core.Tr(fmt.Errorf("No acceptable method in %v", buf[:methods]))
+	case METHOD_USERNAME_PASSWORD:
+		user, err = Authenticate(rw, creds)
+	}
 	return
 }
 
@@ -161,20 +188,49 @@ func ReceiveRequest(r net.Conn, req *Request) (err error) {
 // | 1  |  1  | X'00' |  1   | Variable |    2     |
 // +----+-----+-------+------+----------+----------+
 func SendReply(w net.Conn, r Reply) (err error) {
-	// FIXME: Respect Reply.
 	w.SetWriteDeadline(time.Now().Add(HANDSHAKE_TIMEOUT * time.Second))
-	if _, err = w.Write([]byte{r.VER, r.REP, 0, r.ATYP}); err != nil {
+	if _, err = w.Write(r.Bytes()); err != nil {
 		return core.Tr(err)
 	}
-	w.SetWriteDeadline(time.Now().Add(HANDSHAKE_TIMEOUT * time.Second))
-	if _, err = w.Write(r.BND_ADDR); err != nil {
-		return core.Tr(err)
+	return
+}
+
+func (self *Reply) Bytes() []byte {
+	b := []byte{self.VER, self.REP, self.RSV, self.ATYP}
+	b = append(b, self.BND_ADDR...)
+	return append(b, self.BND_PORT[:]...)
+}
+
+// ReplyOfDialError returns REP telling why the destination wasn't dialed, or
+// REP_GENERAL_SERVER_FAILURE if err isn't a core.DialError.
+func ReplyOfDialError(err error) byte {
+	var de *core.DialError
+	if !errors.As(err, &de) {
+		return REP_GENERAL_SERVER_FAILURE
 	}
-	w.SetWriteDeadline(time.Now().Add(HANDSHAKE_TIMEOUT * time.Second))
-	if _, err = w.Write(r.BND_PORT[:]); err != nil {
-		return core.Tr(err)
+	switch de.Class {
+	case core.DIAL_ERROR_UNSUPPORTED_NETWORK:
+		return REP_COMMAND_NOT_SUPPORTED
+	case core.DIAL_ERROR_REFUSED:
+		return REP_CONNECTION_REFUSED
+	case core.DIAL_ERROR_NETWORK_UNREACHABLE:
+		return REP_NETWORK_UNREACHABLE
+	case core.DIAL_ERROR_HOST_UNREACHABLE:
+		return REP_HOST_UNREACHABLE
+	case core.DIAL_ERROR_TIMEOUT:
+		return REP_TTL_EXPIRED
 	}
-	return
+	return REP_GENERAL_SERVER_FAILURE
+}
+
+// NewReply returns a reply of VER whose BND is addr, or a zero IPv4 address
+// if addr is nil.
+func NewReply(rep byte, addr *net.TCPAddr) Reply {
+	r := Reply{VER: VER, REP: rep, ATYP: ATYP_IPV4, BND_ADDR: make([]byte, net.IPv4len)}
+	if addr != nil {
+		r.ATYP, r.BND_ADDR, r.BND_PORT = EncodeAddress(addr.IP, addr.Port)
+	}
+	return r
 }
 
 func GetDialAddress(atyp byte, addr []byte, port [2]byte) string {
@@ -189,14 +245,27 @@ func GetDialAddress(atyp byte, addr []byte, port [2]byte) string {
 	}
 }
 
+// EncodeAddress returns ATYP, ADDR and PORT of ip and port.
+func EncodeAddress(ip net.IP, port int) (atyp byte, addr []byte, p [2]byte) {
+	binary.BigEndian.PutUint16(p[:], uint16(port))
+	if ip4 := ip.To4(); ip4 != nil {
+		return ATYP_IPV4, ip4, p
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return ATYP_IPV6, ip16, p
+	}
+	return ATYP_IPV4, make([]byte, net.IPv4len), p
+}
+
 // +----+------+------+----------+----------+----------+
 // |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
 // +----+------+------+----------+----------+----------+
 // | 2  |  1   |  1   | Variable |    2     | Variable |
 // +----+------+------+----------+----------+----------+
+// DATA of req refers to buf.
 func ParseUDPRequest(buf []byte, req *UDPRequest) error {
 	r := bytes.NewReader(buf)
-	_, err := r.Read(req.RSV[:])
+	_, err := io.ReadFull(r, req.RSV[:])
 	if err != nil {
 		return core.Tr(err)
 	}
@@ -211,16 +280,8 @@ func ParseUDPRequest(buf []byte, req *UDPRequest) error {
 	switch req.ATYP {
 	case ATYP_IPV4:
 		req.DST_ADDR = make([]byte, net.IPv4len)
-		_, err = r.Read(req.DST_ADDR)
-		if err != nil {
-			return core.Tr(err)
-		}
 	case ATYP_IPV6:
 		req.DST_ADDR = make([]byte, net.IPv6len)
-		_, err = r.Read(req.DST_ADDR)
-		if err != nil {
-			return core.Tr(err)
-		}
 	case ATYP_DOMAINNAME:
 		l, err := r.ReadByte()
 		if err != nil {
@@ -228,19 +289,97 @@ func ParseUDPRequest(buf []byte, req *UDPRequest) error {
 		}
 		req.DST_ADDR = make([]byte, int(l)+1)
 		req.DST_ADDR[0] = l
-		_, err = r.Read(req.DST_ADDR[1:])
-		if err != nil {
-			return core.Tr(err)
-		}
+	default:
+		return core.Tr(fmt.Errorf("Unsupported ATYP: %d", req.ATYP))
+	}
+	if req.ATYP == ATYP_DOMAINNAME {
+		_, err = io.ReadFull(r, req.DST_ADDR[1:])
+	} else {
+		_, err = io.ReadFull(r, req.DST_ADDR)
 	}
-	_, err = r.Read(req.DST_PORT[:])
 	if err != nil {
 		return core.Tr(err)
 	}
-	req.DATA = make([]byte, r.Len())
-	_, err = r.Read(req.DATA)
+	_, err = io.ReadFull(r, req.DST_PORT[:])
 	if err != nil {
 		return core.Tr(err)
 	}
+	// DATA might be empty.
+	req.DATA = buf[len(buf)-r.Len():]
 	return nil
 }
+
+// Header returns the request without DATA.
+func (self *UDPRequest) Header() []byte {
+	h := []byte{self.RSV[0], self.RSV[1], self.FRAG, self.ATYP}
+	h = append(h, self.DST_ADDR...)
+	return append(h, self.DST_PORT[:]...)
+}
+
+func (self *UDPRequest) Bytes() []byte {
+	return append(self.Header(), self.DATA...)
+}
+
+// Fragments not completed in REASSEMBLY_TIMEOUT seconds are dropped.
+const REASSEMBLY_TIMEOUT = 5
+
+// Reassembler reassembles fragments of UDP requests of an association, see
+// section 7 of RFC 1928. Only one sequence of fragments is reassembled at a
+// time, and it's dropped once a fragment is missing or it exceeds Max.
+type Reassembler struct {
+	// Maximum bytes of DATA reassembled, unlimited if zero.
+	Max   int
+	queue []*UDPRequest
+	// Position of the last queued fragment.
+	last  byte
+	start time.Time
+	size  int
+}
+
+func (self *Reassembler) reset() {
+	self.queue = nil
+	self.last = 0
+	self.size = 0
+}
+
+// Add returns the reassembled request once the end of the sequence arrives,
+// or req itself if it's standalone. Otherwise nil is returned. DATA of
+// fragments is retained until the sequence completes.
+func (self *Reassembler) Add(req *UDPRequest) *UDPRequest {
+	if req.FRAG == 0 {
+		self.reset()
+		return req
+	}
+	pos := req.FRAG & 0x7f
+	if pos == 0 {
+		return nil
+	}
+	if pos != self.last+1 || time.Since(self.start) > REASSEMBLY_TIMEOUT*time.Second {
+		self.reset()
+	}
+	// A sequence missing its beginning can't be completed.
+	if len(self.queue) == 0 {
+		if pos != 1 {
+			return nil
+		}
+		self.start = time.Now()
+	}
+	self.size += len(req.DATA)
+	if self.Max != 0 && self.size > self.Max {
+		self.reset()
+		return nil
+	}
+	self.queue = append(self.queue, req)
+	self.last = pos
+	if req.FRAG&0x80 == 0 {
+		return nil
+	}
+	r := *self.queue[0]
+	r.FRAG = 0
+	r.DATA = nil
+	for _, f := range self.queue {
+		r.DATA = append(r.DATA, f.DATA...)
+	}
+	self.reset()
+	return &r
+}
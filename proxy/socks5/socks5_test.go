@@ -0,0 +1,138 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/bzEq/bxrx/core"
+)
+
+func TestUDPRequest(t *testing.T) {
+	atyp, addr, port := EncodeAddress(net.IPv4(10, 0, 0, 1), 53)
+	req := UDPRequest{ATYP: atyp, DST_ADDR: addr, DST_PORT: port}
+	var parsed UDPRequest
+	if err := ParseUDPRequest(req.Bytes(), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if a := GetDialAddress(parsed.ATYP, parsed.DST_ADDR, parsed.DST_PORT); a != "10.0.0.1:53" {
+		t.Fatal(a)
+	}
+	if len(parsed.DATA) != 0 {
+		t.Fail()
+	}
+	if err := ParseUDPRequest(req.Bytes()[:6], &parsed); err == nil {
+		t.Fail()
+	}
+}
+
+func TestReassembler(t *testing.T) {
+	var r Reassembler
+	frag := func(frag byte, data string) *UDPRequest {
+		return &UDPRequest{FRAG: frag, ATYP: ATYP_IPV4, DST_ADDR: make([]byte, net.IPv4len), DATA: []byte(data)}
+	}
+	if r.Add(frag(1, "a")) != nil || r.Add(frag(2, "b")) != nil {
+		t.Fail()
+	}
+	if req := r.Add(frag(0x83, "c")); req == nil || string(req.DATA) != "abc" || req.FRAG != 0 {
+		t.Fatal(req)
+	}
+	// A missing fragment drops the queue.
+	r.Add(frag(2, "x"))
+	r.Add(frag(1, "a"))
+	if req := r.Add(frag(0x82, "b")); req == nil || string(req.DATA) != "ab" {
+		t.Fatal(req)
+	}
+	// A standalone datagram drops the queue.
+	r.Add(frag(1, "x"))
+	if req := r.Add(frag(0, "s")); string(req.DATA) != "s" {
+		t.Fatal(req)
+	}
+	if r.Add(frag(0x82, "b")) != nil {
+		t.Fatal("Queue is not dropped")
+	}
+	// A sequence exceeding Max is dropped.
+	r.Max = 2
+	r.Add(frag(1, "ab"))
+	if r.Add(frag(2, "c")) != nil || r.Add(frag(0x83, "d")) != nil {
+		t.Fatal("Oversized sequence is reassembled")
+	}
+}
+
+func testExchangeMetadata(t *testing.T, creds *Credentials, client []byte, reply []byte) (string, error) {
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+	// Pipes are synchronous, so writes don't wait for reads.
+	go c0.Write(client)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, len(reply))
+		if _, err := io.ReadFull(c0, buf); err != nil || !bytes.Equal(buf, reply) {
+			t.Error(err, buf)
+		}
+	}()
+	defer func() { <-done }()
+	return ExchangeMetadata(c1, creds)
+}
+
+func TestExchangeMetadata(t *testing.T) {
+	creds, err := ParseCredentials(strings.NewReader("# Users\nalice:secret:1\n\nbob:hunter2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, err := testExchangeMetadata(t, nil, []byte{VER, 1, METHOD_NO_AUTH}, []byte{VER, METHOD_NO_AUTH}); err != nil || user != "" {
+		t.Fatal(user, err)
+	}
+	if _, err := testExchangeMetadata(t, creds, []byte{VER, 1, METHOD_NO_AUTH}, []byte{VER, METHOD_NO_ACCEPTABLE}); err == nil {
+		t.Fail()
+	}
+	auth := func(user, password string) []byte {
+		b := []byte{VER, 2, METHOD_NO_AUTH, METHOD_USERNAME_PASSWORD, AUTH_VER, byte(len(user))}
+		b = append(b, user...)
+		b = append(b, byte(len(password)))
+		return append(b, password...)
+	}
+	if user, err := testExchangeMetadata(t, creds, auth("alice", "secret:1"), []byte{VER, METHOD_USERNAME_PASSWORD, AUTH_VER, AUTH_SUCC}); err != nil || user != "alice" {
+		t.Fatal(user, err)
+	}
+	if _, err := testExchangeMetadata(t, creds, auth("bob", "secret:1"), []byte{VER, METHOD_USERNAME_PASSWORD, AUTH_VER, AUTH_FAILURE}); err == nil {
+		t.Fail()
+	}
+	if user, _ := creds.First(); user != "alice" {
+		t.Fatal(user)
+	}
+}
+
+func TestParseCredentials(t *testing.T) {
+	for _, s := range []string{"", "alice", "alice:", "alice:a\nalice:b"} {
+		if _, err := ParseCredentials(strings.NewReader(s)); err == nil {
+			t.Fatal(s)
+		}
+	}
+}
+
+func TestReplyOfDialError(t *testing.T) {
+	for err, rep := range map[error]byte{
+		core.NewDialError("a:1", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}): REP_CONNECTION_REFUSED,
+		core.NewDialError("a:1", syscall.ENETUNREACH):                                                                REP_NETWORK_UNREACHABLE,
+		core.NewDialError("a:1", &net.DNSError{Err: "no such host"}):                                                 REP_HOST_UNREACHABLE,
+		fmt.Errorf("Relaying: %w", core.NewDialError("a:1", os.ErrDeadlineExceeded)):                                 REP_TTL_EXPIRED,
+		core.NewDialError("a:1", core.ErrUnsupportedNetwork):                                                         REP_COMMAND_NOT_SUPPORTED,
+		// Errors of the tunnel tell nothing about the destination.
+		&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}: REP_GENERAL_SERVER_FAILURE,
+		os.ErrDeadlineExceeded:         REP_GENERAL_SERVER_FAILURE,
+		errors.New("Tunnel is broken"): REP_GENERAL_SERVER_FAILURE,
+	} {
+		if r := ReplyOfDialError(err); r != rep {
+			t.Fatal(err, r)
+		}
+	}
+}
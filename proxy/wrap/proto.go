@@ -4,4 +4,75 @@ type TCPRequest struct {
 	// Do not use net.TCPAddr here, since we intend to let the remote peer to
 	// resolve the domain name.
 	Addr string
+	// Empty means core.NETWORK_TCP. Frames of core.NETWORK_UDP carry
+	// length-prefixed SOCKS5 UDP requests, Addr is ignored.
+	Network string
+}
+
+const (
+	STATUS_OK = iota
+	// The accepting peer failed to dial, Class tells why.
+	STATUS_DIAL_FAILED
+	// The network of the request is not supported.
+	STATUS_BAD_REQUEST
+)
+
+// Sent by the accepting peer once it dialed the request. It's prefixed by its
+// length as an uvarint, since mux streams don't keep frame boundaries.
+type TCPResponse struct {
+	Status int
+	// One of core.DIAL_ERROR_*.
+	Class int
+	Error string
+	// The address the accepting peer dialed from, or listens at for BIND. It
+	// might be empty.
+	Bound string
+}
+
+// Version of the wrap protocol. Peers speak the lower of their versions,
+// which must not be lower than MIN_VERSION.
+//  1. Pipeline negotiation.
+//  2. Frames after the hello are marked as data or chaff by a trailing byte.
+//  3. The mark leads frames, so they can be unpacked as streams.
+//  4. Requests are answered by TCPResponse. Streams can be multiplexed over
+//     the connection and are opened by their TCPRequests.
+const (
+	VERSION              = 4
+	MIN_VERSION          = 1
+	CHAFF_VERSION        = 2
+	LEADING_MARK_VERSION = 3
+	MUX_VERSION          = 4
+	RESPONSE_VERSION     = 4
+)
+
+// Sent by the dialing peer before any request. Both peers derive session keys
+// from the X25519 exchange of their ephemeral public keys.
+type Hello struct {
+	Version   int
+	PublicKey []byte
+	// Unix time in seconds, checked against the replay window of the
+	// accepting peer.
+	Time int64
+	// Canonical specs of supported pipelines, in order of preference.
+	Pipelines []string
+	// Digest of the size distribution frames are morphed to once the session
+	// is set, empty if frames aren't morphed. It must match the accepting
+	// peer's.
+	Morph string
+	// Asks to multiplex streams over the connection instead of sending a
+	// TCPRequest. Streams are opened with their TCPRequests instead.
+	Mux bool
+}
+
+// If Error is not empty, the accepting peer rejected the hello and closes the
+// connection, other fields are meaningless.
+type HelloReply struct {
+	Version   int
+	PublicKey []byte
+	// The pipeline applied to frames after the handshake.
+	Pipeline string
+	// Whether streams are multiplexed over the connection, i.e., core.Mux
+	// frames follow the hello. It's only set if asked by the hello.
+	Mux   bool
+	Error string
 }
@@ -4,28 +4,37 @@ package main
 
 import (
 	crand "crypto/rand"
+	"crypto/tls"
 	"encoding/binary"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/bzEq/bxrx/core"
+	"github.com/bzEq/bxrx/pass"
 	h1p "github.com/bzEq/bxrx/proxy/http"
+	"github.com/bzEq/bxrx/proxy/socks5"
 	"github.com/bzEq/bxrx/relayer"
 )
 
 var options relayer.Options
 
-func proxyLocalHTTP(be core.Backend) {
+func proxyLocalHTTP(be core.Backend, creds *socks5.Credentials) {
 	socksProxyURL, err := url.Parse("socks5://" + options.LocalAddr)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	if creds != nil {
+		socksProxyURL.User = url.UserPassword(creds.First())
+	}
 	fe := relayer.NewHTTPProxyFE()
 	proxy := &h1p.HTTPProxy{
 		Transport: &http.Transport{Proxy: http.ProxyURL(socksProxyURL)},
@@ -42,7 +51,53 @@ func proxyLocalHTTP(be core.Backend) {
 	}
 }
 
-func relay() {
+const DEFAULT_TLS_CERT = "r7.crt"
+const DEFAULT_TLS_KEY = "r7.key"
+
+func createTLSConfig() (*tls.Config, error) {
+	if (options.TLSCert == "") != (options.TLSKey == "") {
+		return nil, fmt.Errorf("-tls_cert and -tls_key must be given together")
+	}
+	if options.NextHop == "" {
+		if options.TLSCert == "" {
+			options.TLSCert, options.TLSKey = DEFAULT_TLS_CERT, DEFAULT_TLS_KEY
+		}
+		cert, err := core.LoadOrCreateCertificate(options.TLSCert, options.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Certificate fingerprint", core.CertificateFingerprint(cert.Certificate[0]))
+		return core.CreateTLSServerConfig(cert, options.TLSClientCA)
+	}
+	var cert *tls.Certificate
+	if options.TLSCert != "" {
+		c, err := core.LoadOrCreateCertificate(options.TLSCert, options.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		cert = &c
+	}
+	host, _, err := net.SplitHostPort(options.NextHop)
+	if err != nil {
+		return nil, err
+	}
+	return core.CreateTLSClientConfig(host, cert, options.TLSPin), nil
+}
+
+// The next hop as it's named, rather than the address it resolves to. Default
+// ports of HTTP and HTTPS are omitted, as browsers do.
+func defaultWSHost(nextHop string) string {
+	host, port, err := net.SplitHostPort(nextHop)
+	if err != nil || (port != "80" && port != "443") {
+		return nextHop
+	}
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+func relay(specs []*pass.Spec, morph *pass.SizeDistribution, chaff *core.ChaffConfig, pool *relayer.PoolConfig) {
 	log.Println("Listening on", options.LocalAddr)
 	ln, err := net.Listen("tcp", options.LocalAddr)
 	if err != nil {
@@ -52,16 +107,77 @@ func relay() {
 	defer ln.Close()
 	var fe core.Frontend
 	var be core.Backend
-	pipeline := &relayer.Pipeline{}
+	pipeline := &relayer.Pipeline{
+		Specs:         specs,
+		Server:        options.NextHop == "",
+		WSHost:        options.WSHost,
+		WSPath:        options.WSPath,
+		Morph:         morph,
+		MorphOverhead: options.MorphOverhead,
+	}
+	if pipeline.WSHost == "" && options.NextHop != "" {
+		pipeline.WSHost = defaultWSHost(options.NextHop)
+	}
+	if options.Key != "" {
+		key := pass.KeyFromPassphrase(options.Key)
+		aead, err := pass.NewAEAD(key)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		pipeline.AEAD = aead
+		pipeline.HandshakeKey = pass.DeriveKey(key, nil, "bxrx handshake codec")
+	}
+	var pb core.PortBuilder = pipeline
+	if options.TLS {
+		config, err := createTLSConfig()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		pb = &relayer.TLSPortBuilder{Config: config, Server: pipeline.Server, Next: pipeline}
+	}
 	if options.NextHop == "" {
-		fe = relayer.NewWrapFE(ln.(*net.TCPListener), pipeline)
+		var wfe *relayer.WrapFE
+		if options.HTTPTunnel != "" {
+			ts := h1p.NewTunnelServer(ln.Addr())
+			mux := http.NewServeMux()
+			mux.Handle(options.HTTPTunnel, ts)
+			go http.Serve(ln, mux)
+			wfe = relayer.NewWrapFE(ts, pb)
+		} else {
+			wfe = relayer.NewWrapFE(ln, pb)
+		}
+		wfe.Chaff = chaff
+		fe = wfe
 		be = &relayer.TCPBE{}
 	} else {
-		fe = relayer.NewSocks5FE(ln.(*net.TCPListener))
+		sfe := relayer.NewSocks5FE(ln.(*net.TCPListener))
+		if options.SocksCredentials != "" {
+			creds, err := socks5.LoadCredentials(options.SocksCredentials)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			sfe.Credentials = creds
+		}
+		fe = sfe
 		log.Println("Backend is connecting to", options.NextHop)
-		be = relayer.NewWrapBE(options.NextHop, pipeline)
+		var wbe *relayer.WrapBE
+		if options.HTTPTunnel != "" {
+			tc := &h1p.TunnelClient{Client: &http.Client{}, Path: options.HTTPTunnel}
+			wbe = relayer.NewWrapBEWithDialer(options.NextHop, pb, tc)
+		} else {
+			wbe = relayer.NewWrapBE(options.NextHop, pb)
+		}
+		wbe.Chaff = chaff
+		wbe.Mux = options.Mux
+		if pool != nil && !options.Mux {
+			wbe.EnablePool(*pool)
+		}
+		be = wbe
 		if options.LocalHTTPProxy != "" {
-			go proxyLocalHTTP(be)
+			go proxyLocalHTTP(be, sfe.Credentials)
 		}
 	}
 	r := core.NewRelayer(fe, be)
@@ -80,10 +196,78 @@ func main() {
 	flag.StringVar(&options.LocalAddr, "l", "localhost:1080", "Listen address of this relayer")
 	flag.StringVar(&options.NextHop, "n", "", "Address of next-hop relayer")
 	flag.StringVar(&options.LocalHTTPProxy, "http_proxy", "", "Enable this relayer serving as http proxy")
+	flag.StringVar(&options.SocksCredentials, "socks_credentials", "", "Require SOCKS5 clients to authenticate by username and password in this file, which has a username:password per line")
+	flag.StringVar(&options.Key, "key", "", "Pre-shared key to encrypt traffic between relayers")
+	flag.StringVar(&options.HTTPTunnel, "http_tunnel", "", "Carry traffic between relayers by HTTP requests to this path, e.g., /tunnel")
+	flag.BoolVar(&options.TLS, "tls", false, "Secure traffic between relayers with TLS")
+	flag.StringVar(&options.TLSCert, "tls_cert", "", "Certificate file, created along with the key file if neither exists. Servers use r7.crt and r7.key by default")
+	flag.StringVar(&options.TLSKey, "tls_key", "", "Private key file of the certificate")
+	flag.StringVar(&options.TLSClientCA, "tls_client_ca", "", "Require clients to present certificates verified by this PEM file")
+	flag.StringVar(&options.TLSPin, "tls_pin", "", "SHA-256 fingerprint of the next-hop relayer's certificate, required unless it's verified by system roots, e.g., not created by -tls")
+	flag.StringVar(&options.Pipeline, "pipeline", relayer.DEFAULT_PIPELINE_SPEC, "Passes and the carrier, i.e., http, frame, websocket or chunked, applied to traffic between relayers. Multiple pipelines sharing one carrier are separated by ';' in order of preference, relayers agree on one of them")
+	flag.StringVar(&options.Carrier, "carrier", "", "Deprecated, use -pipeline. Carries the default passes by this carrier, i.e., http, frame, websocket or chunked")
+	flag.StringVar(&options.WSHost, "ws_host", "", "Host header of WebSocket requests to the next-hop relayer, which CDNs and reverse proxies route on. It's the next-hop address by default")
+	flag.StringVar(&options.WSPath, "ws_path", "/", "Path of WebSocket requests to the next-hop relayer")
+	flag.StringVar(&options.Morph, "morph", "", "Pad or split frames between relayers to follow the size distribution in this file, which has a size and an optional count per line. Relayers on both ends must morph to the same distribution")
+	flag.Float64Var(&options.MorphOverhead, "morph_overhead", relayer.DEFAULT_MORPH_OVERHEAD, "Maximum bytes spent on morphing per data byte")
+	flag.BoolVar(&options.Mux, "mux", false, "Multiplex connections to the next-hop relayer over one connection")
+	flag.IntVar(&options.PoolMinIdle, "pool_min_idle", 0, "Connections to the next-hop relayer kept warm, i.e., handshaken before being used")
+	flag.IntVar(&options.PoolMaxIdle, "pool_max_idle", 0, "Maximum warm connections to the next-hop relayer, 0 disables the pool. It's not used with -mux")
+	flag.IntVar(&options.PoolMaxIdleTime, "pool_max_idle_time", relayer.DEFAULT_POOL_MAX_IDLE_TIME, "Warm connections idle longer than this many seconds are discarded")
+	flag.StringVar(&options.Chaff, "chaff", "", "Send chaff between relayers when links are idle, at poisson or constant intervals")
+	flag.IntVar(&options.ChaffInterval, "chaff_interval", core.DEFAULT_CHAFF_INTERVAL, "Mean interval between chaff frames in milliseconds")
+	flag.IntVar(&options.ChaffSize, "chaff_size", core.DEFAULT_CHAFF_SIZE, "Maximum size of chaff frames")
+	flag.IntVar(&options.ChaffBudget, "chaff_budget", core.DEFAULT_CHAFF_BUDGET, "Bytes of chaff per second per connection")
 	flag.Parse()
+	if options.Carrier != "" {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "pipeline" {
+				log.Fatal("-carrier is deprecated and conflicts with -pipeline, specify the carrier in -pipeline only")
+			}
+		})
+		options.Pipeline = relayer.DEFAULT_PASSES_SPEC + ">" + options.Carrier
+		log.Printf("-carrier is deprecated, use -pipeline %q instead", options.Pipeline)
+	}
+	specs, err := relayer.ParsePipelineSpecs(options.Pipeline)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var morph *pass.SizeDistribution
+	if options.Morph != "" {
+		if morph, err = pass.LoadSizeDistribution(options.Morph); err != nil {
+			log.Fatal(err)
+		}
+		if specs[0].Carrier == relayer.CARRIER_CHUNKED {
+			log.Fatal("Morphing is not supported by the chunked carrier")
+		}
+	}
 	if !debug {
 		log.SetOutput(io.Discard)
 	}
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	relay()
+	var chaff *core.ChaffConfig
+	if options.Chaff != "" {
+		chaff = &core.ChaffConfig{
+			Model:    options.Chaff,
+			Interval: time.Duration(options.ChaffInterval) * time.Millisecond,
+			MaxSize:  options.ChaffSize,
+			Budget:   options.ChaffBudget,
+		}
+		if err := chaff.Validate(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var pool *relayer.PoolConfig
+	if options.PoolMaxIdle > 0 {
+		pool = &relayer.PoolConfig{
+			MinIdle:       options.PoolMinIdle,
+			MaxIdle:       options.PoolMaxIdle,
+			MaxIdleTime:   time.Duration(options.PoolMaxIdleTime) * time.Second,
+			CheckInterval: relayer.DEFAULT_POOL_CHECK_INTERVAL * time.Second,
+		}
+		if err := pool.Validate(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	relay(specs, morph, chaff, pool)
 }
@@ -0,0 +1,233 @@
+// Copyright (c) 2026 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package relayer
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bzEq/bxrx/core"
+	"github.com/bzEq/bxrx/proxy/socks5"
+)
+
+// Seconds to wait for the inbound connection of a BIND.
+const DEFAULT_BIND_TIMEOUT = 120
+
+// bindPort listens on behalf of a SOCKS5 client issuing BIND. The first frame
+// unpacked is the reply of the listening address, the second is the reply of
+// the accepted peer, then the accepted connection is relayed. Replies are sent
+// in band, so the entry relays them to the client as they are.
+type bindPort struct {
+	ln *net.TCPListener
+	// The address reported to the client.
+	bnd *net.TCPAddr
+	// Hosts the inbound connection is accepted from, any if empty.
+	peers   []net.IP
+	timeout time.Duration
+	bound   bool
+	// Set once the inbound connection is accepted or failed to.
+	mu       sync.Mutex
+	c        *core.RawNetPort
+	err      error
+	accepted chan struct{}
+	once     sync.Once
+}
+
+// Routed by the default route when DST.ADDR of a BIND is unspecified.
+var DEFAULT_ROUTE_PROBE = net.IPv4(192, 0, 2, 1)
+
+// The local address routing to ip. Without such a route, the first global
+// unicast address of the interfaces is returned, or the unspecified address
+// if there is none.
+func localIPTo(ip net.IP) net.IP {
+	// Nothing is sent by connecting a UDP socket.
+	if c, err := net.Dial("udp", net.JoinHostPort(ip.String(), "9")); err == nil {
+		defer c.Close()
+		if local := c.LocalAddr().(*net.UDPAddr).IP; !local.IsUnspecified() {
+			return local
+		}
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipn, ok := addr.(*net.IPNet); ok && ipn.IP.IsGlobalUnicast() {
+				return ipn.IP
+			}
+		}
+	}
+	return net.IPv4zero
+}
+
+// Resolves hosts addr might connect from. The listening address reported is
+// the local address routing to addr, or by the default route if addr is
+// unspecified, since the listener itself is bound to the unspecified address.
+func newBindPort(addr string, timeout time.Duration) (*bindPort, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, core.Tr(err)
+	}
+	var peers []net.IP
+	if ip := net.ParseIP(host); ip == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, core.Tr(err)
+		}
+		peers = ips
+	} else if !ip.IsUnspecified() {
+		peers = []net.IP{ip}
+	}
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	if err != nil {
+		return nil, core.Tr(err)
+	}
+	route := DEFAULT_ROUTE_PROBE
+	if len(peers) != 0 {
+		route = peers[0]
+	}
+	bnd := &net.TCPAddr{IP: localIPTo(route), Port: ln.Addr().(*net.TCPAddr).Port}
+	return &bindPort{
+		ln:       ln,
+		bnd:      bnd,
+		peers:    peers,
+		timeout:  timeout,
+		accepted: make(chan struct{}),
+	}, nil
+}
+
+func (self *bindPort) allowed(ip net.IP) bool {
+	if len(self.peers) == 0 {
+		return true
+	}
+	for _, p := range self.peers {
+		if p.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *bindPort) accept() (*net.TCPConn, error) {
+	if err := self.ln.SetDeadline(time.Now().Add(self.timeout)); err != nil {
+		return nil, core.Tr(err)
+	}
+	for {
+		c, err := self.ln.AcceptTCP()
+		if err != nil {
+			return nil, core.Tr(err)
+		}
+		if ip := c.RemoteAddr().(*net.TCPAddr).IP; !self.allowed(ip) {
+			log.Println("Rejecting connection from", ip, "to", self.ln.Addr())
+			c.Close()
+			continue
+		}
+		return c, nil
+	}
+}
+
+// Only the first outcome is taken, so a connection accepted after Close is
+// closed.
+func (self *bindPort) settle(c *net.TCPConn, err error) bool {
+	settled := false
+	self.once.Do(func() {
+		self.mu.Lock()
+		if c != nil {
+			self.c = core.NewRawNetPort(c)
+		}
+		self.err = err
+		self.mu.Unlock()
+		close(self.accepted)
+		settled = true
+	})
+	self.ln.Close()
+	if !settled && c != nil {
+		c.Close()
+	}
+	return settled
+}
+
+func (self *bindPort) conn() (*core.RawNetPort, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.c, self.err
+}
+
+func (self *bindPort) Unpack(b *core.IoVec) error {
+	if !self.bound {
+		self.bound = true
+		r := socks5.NewReply(socks5.REP_SUCC, self.bnd)
+		b.Take(r.Bytes())
+		return nil
+	}
+	c, err := self.conn()
+	if err != nil {
+		return core.Tr(err)
+	}
+	if c != nil {
+		return c.Unpack(b)
+	}
+	tc, err := self.accept()
+	if !self.settle(tc, err) {
+		return core.Tr(net.ErrClosed)
+	}
+	if err != nil {
+		// The client is told before the stream ends.
+		r := socks5.NewReply(socks5.REP_GENERAL_SERVER_FAILURE, nil)
+		b.Take(r.Bytes())
+		return nil
+	}
+	log.Println("Accepted", tc.RemoteAddr(), "at", tc.LocalAddr())
+	r := socks5.NewReply(socks5.REP_SUCC, tc.RemoteAddr().(*net.TCPAddr))
+	b.Take(r.Bytes())
+	return nil
+}
+
+// Blocks until the inbound connection is accepted.
+func (self *bindPort) Pack(b *core.IoVec) error {
+	<-self.accepted
+	c, err := self.conn()
+	if err != nil {
+		return core.Tr(err)
+	}
+	return c.Pack(b)
+}
+
+func (self *bindPort) Recycle() {
+	if c, _ := self.conn(); c != nil {
+		c.Recycle()
+	}
+}
+
+func (self *bindPort) CloseRead() error {
+	if c, _ := self.conn(); c != nil {
+		return c.CloseRead()
+	}
+	return nil
+}
+
+// The client might be done before the inbound connection is accepted.
+func (self *bindPort) CloseWrite() error {
+	if c, _ := self.conn(); c != nil {
+		return c.CloseWrite()
+	}
+	return self.Close()
+}
+
+func (self *bindPort) Close() error {
+	self.settle(nil, net.ErrClosed)
+	if c, _ := self.conn(); c != nil {
+		return c.Close()
+	}
+	return nil
+}
+
+func (self *bindPort) LocalAddr() net.Addr {
+	return self.ln.Addr()
+}
+
+func (self *bindPort) RemoteAddr() net.Addr {
+	if c, _ := self.conn(); c != nil {
+		return c.RemoteAddr()
+	}
+	return &net.TCPAddr{}
+}
@@ -0,0 +1,131 @@
+package relayer
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bzEq/bxrx/core"
+	"github.com/bzEq/bxrx/pass"
+	"github.com/bzEq/bxrx/proxy/socks5"
+)
+
+// Reads a reply of an IPv4 address.
+func readReply(t *testing.T, c net.Conn) (byte, *net.TCPAddr) {
+	var buf [10]byte
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, buf[:]); err != nil {
+		t.Fatal(err)
+	}
+	if buf[3] != socks5.ATYP_IPV4 {
+		t.Fatal(buf)
+	}
+	return buf[1], &net.TCPAddr{IP: net.IP(buf[4:8]), Port: int(buf[8])<<8 | int(buf[9])}
+}
+
+func TestBind(t *testing.T) {
+	wln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wln.Close()
+	fe := NewWrapFE(wln, &Pipeline{Specs: []*pass.Spec{frameSpec}})
+	be := NewWrapBE(wln.Addr().String(), &Pipeline{Specs: []*pass.Spec{frameSpec}})
+	sln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sln.Close()
+	go relayOne(NewSocks5FE(sln), be)
+	go relayOne(fe, &TCPBE{})
+	c, err := net.Dial("tcp", sln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte{socks5.VER, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte{socks5.VER, socks5.CMD_BIND, 0, socks5.ATYP_IPV4, 127, 0, 0, 1, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	rep, bnd := readReply(t, c)
+	if rep != socks5.REP_SUCC || !bnd.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatal(rep, bnd)
+	}
+	inbound, err := net.DialTCP("tcp", nil, bnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inbound.Close()
+	rep, peer := readReply(t, c)
+	if rep != socks5.REP_SUCC || peer.String() != inbound.LocalAddr().String() {
+		t.Fatal(rep, peer)
+	}
+	inbound.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatal(err, string(buf))
+	}
+	c.Write([]byte("pong"))
+	inbound.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(inbound, buf); err != nil || string(buf) != "pong" {
+		t.Fatal(err, string(buf))
+	}
+}
+
+func TestBindRejectsPeer(t *testing.T) {
+	p, err := newBindPort("127.0.0.2:0", 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var b core.IoVec
+	if err := p.Unpack(&b); err != nil {
+		t.Fatal(err)
+	}
+	port := p.LocalAddr().(*net.TCPAddr).Port
+	c, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// The connection is rejected and the BIND times out.
+	b = core.IoVec{}
+	if err := p.Unpack(&b); err != nil {
+		t.Fatal(err)
+	}
+	if r := b.Consume(); r[1] != socks5.REP_GENERAL_SERVER_FAILURE {
+		t.Fatal(r)
+	}
+	if err := p.Unpack(&b); err == nil {
+		t.Fail()
+	}
+}
+
+func TestBindUnspecifiedAddr(t *testing.T) {
+	p, err := newBindPort("0.0.0.0:0", 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var b core.IoVec
+	if err := p.Unpack(&b); err != nil {
+		t.Fatal(err)
+	}
+	local := localIPTo(DEFAULT_ROUTE_PROBE)
+	if local.IsUnspecified() || local.To4() == nil {
+		t.Skip("No IPv4 route or global unicast address")
+	}
+	r := b.Consume()
+	if r[1] != socks5.REP_SUCC || r[3] != socks5.ATYP_IPV4 {
+		t.Fatal(r)
+	}
+	if ip := net.IP(r[4:8]); !ip.Equal(local) {
+		t.Fatal(ip, local)
+	}
+}
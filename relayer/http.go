@@ -16,8 +16,14 @@ func NewHTTPProxyFE() *HTTPProxyFE {
 	}
 }
 
-func (self *HTTPProxyFE) Capture(c net.Conn, raddr string) {
-	self.ch <- core.AcceptResult{core.NewRawNetPort(c), raddr}
+func (self *HTTPProxyFE) Capture(c net.Conn, raddr string, reply func(error) error) {
+	self.ch <- core.AcceptResult{
+		Port: core.NewRawNetPort(c),
+		Addr: raddr,
+		Reply: func(bound net.Addr, err error) error {
+			return reply(err)
+		},
+	}
 }
 
 func (self *HTTPProxyFE) Accept() (ch chan core.AcceptResult) {
@@ -3,60 +3,280 @@
 package relayer
 
 import (
+	"crypto/cipher"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 
 	"github.com/bzEq/bxrx/core"
 	"github.com/bzEq/bxrx/pass"
 )
 
-func createRandomCodec() (*pass.RandomEncoder, *pass.RandomDecoder) {
-	enc := &pass.RandomEncoder{}
-	dec := &pass.RandomDecoder{}
-	{
-		pmb := &core.PackUnpackPassManagerBuilder{}
-		pmb.AddPairedPasses(&pass.TailPaddingEncoder{}, &pass.TailPaddingDecoder{})
-		pmb.AddPairedPasses(&pass.OBFSEncoder{}, &pass.OBFSDecoder{})
-		enc.AddPM(pmb.BuildPackPassManager())
-		dec.AddPM(pmb.BuildUnpackPassManager())
-	}
-	{
-		pmb := &core.PackUnpackPassManagerBuilder{}
-		pmb.AddPairedPasses(&pass.TailPaddingEncoder{}, &pass.TailPaddingDecoder{})
-		pmb.AddPairedPasses(&pass.OBFSEncoder{}, &pass.OBFSDecoder{})
-		pmb.AddPairedPasses(&pass.TailPaddingEncoder{}, &pass.TailPaddingDecoder{})
-		enc.AddPM(pmb.BuildPackPassManager())
-		dec.AddPM(pmb.BuildUnpackPassManager())
-	}
-	{
-		pmb := &core.PackUnpackPassManagerBuilder{}
-		pmb.AddPairedPasses(&pass.OBFSEncoder{}, &pass.OBFSDecoder{})
-		enc.AddPM(pmb.BuildPackPassManager())
-		dec.AddPM(pmb.BuildUnpackPassManager())
-	}
-	{
-		pmb := &core.PackUnpackPassManagerBuilder{}
-		pmb.AddPairedPasses(&pass.OBFSEncoder{}, &pass.OBFSDecoder{})
-		pmb.AddPairedPasses(&pass.TailPaddingEncoder{}, &pass.TailPaddingDecoder{})
-		enc.AddPM(pmb.BuildPackPassManager())
-		dec.AddPM(pmb.BuildUnpackPassManager())
-	}
-	return enc, dec
-}
-
-type Pipeline struct{}
+const (
+	CARRIER_HTTP    = "http"
+	CARRIER_FRAME   = "frame"
+	CARRIER_WS      = "websocket"
+	CARRIER_CHUNKED = "chunked"
+)
+
+var CARRIERS = []string{CARRIER_HTTP, CARRIER_FRAME, CARRIER_WS, CARRIER_CHUNKED}
+
+const DEFAULT_PASSES_SPEC = "random(pad|obfs, pad|obfs|pad, obfs, obfs|pad)"
+
+const DEFAULT_PIPELINE_SPEC = DEFAULT_PASSES_SPEC + ">" + CARRIER_HTTP
+
+// ParsePipelineSpec parses spec and validates passes and the carrier in it.
+// Frames are carried by HTTP if no carrier is specified.
+func ParsePipelineSpec(spec string) (*pass.Spec, error) {
+	s, err := pass.ParseSpec(spec, CARRIERS...)
+	if err != nil {
+		return nil, err
+	}
+	if s.Carrier == "" {
+		s.Carrier = CARRIER_HTTP
+	}
+	return s, nil
+}
+
+// ParsePipelineSpecs parses specs separated by ';' in order of preference.
+// Peers agree on one of them in the wrap handshake, which is carried before
+// any pass of the specs applies, so all of them must share one carrier.
+func ParsePipelineSpecs(specs string) ([]*pass.Spec, error) {
+	var r []*pass.Spec
+	for _, spec := range strings.Split(specs, ";") {
+		s, err := ParsePipelineSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		if len(r) != 0 && s.Carrier != r[0].Carrier {
+			return nil, fmt.Errorf("Pipeline %q is carried by %s, but %q is carried by %s", s, s.Carrier, r[0], r[0].Carrier)
+		}
+		r = append(r, s)
+	}
+	return r, nil
+}
+
+var defaultSpec = pass.MustParseSpec(DEFAULT_PIPELINE_SPEC, CARRIERS...)
+
+type Pipeline struct {
+	// Passes and the carrier in order of preference, DEFAULT_PIPELINE_SPEC if
+	// empty. All of them must share one carrier.
+	Specs []*pass.Spec
+	// If not nil, frames are sealed with this AEAD until session keys are set.
+	AEAD cipher.AEAD
+	// Keys the codec of frames before the session is set, which is built from
+	// DEFAULT_PIPELINE_SPEC since peers haven't agreed on a pipeline. It should
+	// be derived from the pre-shared key, otherwise the codec only obfuscates.
+	HandshakeKey []byte
+	// Set on the accepting side. Needed by carriers whose handshake is
+	// asymmetric, e.g., WebSocket.
+	Server bool
+	// The Host header and the path requested by the WebSocket carrier, the
+	// remote address and "/" if empty.
+	WSHost string
+	WSPath string
+	// If not nil, frames after the handshake are padded or split to follow
+	// this distribution of sizes on the wire. Relayers on both ends must morph
+	// to the same distribution, which is checked in the handshake. It's not
+	// supported by the chunked carrier.
+	Morph *pass.SizeDistribution
+	// Maximum bytes spent on morphing per data byte.
+	MorphOverhead float64
+}
 
+const DEFAULT_MORPH_OVERHEAD = 0.5
+
+// Bytes added to every frame below the codec, i.e., the sequence number,
+// the nonce and the tag of AES-GCM and the carrier's header. HTTP headers
+// vary, so it's approximated.
+const sessionOverhead = 8 + 12 + 16
+
+var carrierOverhead = map[string]int{
+	CARRIER_HTTP:    96,
+	CARRIER_FRAME:   4,
+	CARRIER_WS:      8,
+	CARRIER_CHUNKED: 8,
+}
+
+func (self *Pipeline) specs() []*pass.Spec {
+	if len(self.Specs) == 0 {
+		return []*pass.Spec{defaultSpec}
+	}
+	return self.Specs
+}
+
+// Frames of the wrap handshake are carried by the codec of
+// DEFAULT_PIPELINE_SPEC keyed by HandshakeKey, the codec agreed by peers and
+// morphing are installed by PipelinePort.SetSession.
 func (self *Pipeline) FromConn(c net.Conn) core.Port {
-	enc, dec := createRandomCodec()
-	pack := &core.PassManager{}
-	unpack := &core.PassManager{}
+	specs := self.specs()
+	codec := &codecSlot{}
+	decodec := &codecSlot{}
+	codec.Pass, _ = defaultSpec.Build(self.HandshakeKey)
+	_, decodec.Pass = defaultSpec.Build(self.HandshakeKey)
+	seal := &pass.AEADEncoder{AEAD: self.AEAD}
+	open := &pass.AEADDecoder{AEAD: self.AEAD}
+	port := &PipelinePort{
+		specs:   specs,
+		codec:   codec,
+		decodec: decodec,
+		seal:    seal,
+		open:    open,
+		morph:   &morphSlot{},
+		demorph: &morphSlot{},
+	}
+	if self.Morph != nil {
+		port.digest = self.Morph.Digest()
+	}
+	if specs[0].Carrier == CARRIER_CHUNKED {
+		return self.chunked(c, port)
+	}
+	lower := &core.PackUnpackPassManagerBuilder{}
+	lower.AddPairedPasses(&pass.SeqEncoder{}, &pass.SeqDecoder{})
+	lower.AddPairedPasses(seal, open)
+	carrier := specs[0].Carrier
 	mu := &sync.Mutex{}
-	pack.AddPass(enc).AddPass(core.AsSyncPass(pass.NewHTTPEncoder(c), mu))
-	unpack.AddPass(pass.NewHTTPDecoder(c)).AddPass(dec)
-	return core.NewNetPort(c, pack, &HTTP500WrapPass{unpack, c, mu})
+	http500 := false
+	switch carrier {
+	case CARRIER_FRAME:
+		lower.AddPairedPasses(pass.NewFrameEncoder(c), pass.NewFrameDecoder(c))
+	case CARRIER_WS:
+		ws := pass.NewWebSocket(c, self.Server)
+		ws.Host = self.WSHost
+		if self.WSPath != "" {
+			ws.Path = self.WSPath
+		}
+		lower.AddPairedPasses(ws.Encoder(), ws.Decoder())
+	default:
+		lower.AddPairedPasses(core.AsSyncPass(pass.NewHTTPEncoder(c), mu), pass.NewHTTPDecoder(c))
+		http500 = true
+	}
+	pmb := &core.PackUnpackPassManagerBuilder{}
+	pmb.AddPairedPasses(codec, decodec)
+	port.morph.lower, port.demorph.lower = lower.BuildPackPassManager(), lower.BuildUnpackPassManager()
+	if self.Morph != nil {
+		port.morph.morph = &pass.MorphEncoder{
+			Next:        port.morph.lower,
+			Dist:        self.Morph,
+			Overhead:    sessionOverhead + carrierOverhead[carrier],
+			MaxOverhead: self.MorphOverhead,
+		}
+		port.demorph.morph = &pass.MorphDecoder{Prev: port.demorph.lower}
+	}
+	pmb.AddPairedPasses(port.morph, port.demorph)
+	var unpack core.Pass = pmb.BuildUnpackPassManager()
+	if http500 {
+		unpack = &HTTP500WrapPass{unpack, c, mu}
+	}
+	port.Port = core.NewNetPort(c, pmb.BuildPackPassManager(), unpack)
+	return port
+}
+
+// Every record of a frame runs the whole pipeline, so records are decoded and
+// forwarded as they arrive.
+func (self *Pipeline) chunked(c net.Conn, port *PipelinePort) core.Port {
+	record := &core.PackUnpackPassManagerBuilder{}
+	record.AddPairedPasses(port.codec, port.decodec)
+	record.AddPairedPasses(&pass.SeqEncoder{}, &pass.SeqDecoder{})
+	record.AddPairedPasses(port.seal, port.open)
+	enc := pass.NewChunkedHTTPEncoder(record.BuildPackPassManager())
+	dec := pass.NewChunkedHTTPDecoder(record.BuildUnpackPassManager())
+	sp := core.NewStreamNetPort(c, enc, dec)
+	port.Port = sp
+	return &StreamPipelinePort{port, sp}
+}
+
+// Runs the codec installed.
+type codecSlot struct {
+	core.Pass
+}
+
+// Runs lower, i.e., passes below morphing, until morphing is on.
+type morphSlot struct {
+	morph core.Pass
+	lower core.Pass
+	on    bool
+}
+
+func (self *morphSlot) Run(b *core.IoVec) error {
+	if self.on {
+		return self.morph.Run(b)
+	}
+	return self.lower.Run(b)
+}
+
+// PipelinePort is the port built by Pipeline. Its codec is installed and its
+// cipher passes are re-keyed once the wrap handshake agreed on a pipeline and
+// session keys.
+type PipelinePort struct {
+	core.Port
+	specs   []*pass.Spec
+	codec   *codecSlot
+	decodec *codecSlot
+	seal    *pass.AEADEncoder
+	open    *pass.AEADDecoder
+	morph   *morphSlot
+	demorph *morphSlot
+	// Digest of the size distribution, empty if frames aren't morphed.
+	digest string
+}
+
+// Canonical specs of supported pipelines, in order of preference.
+func (self *PipelinePort) Pipelines() []string {
+	var r []string
+	for _, s := range self.specs {
+		r = append(r, s.String())
+	}
+	return r
+}
+
+func (self *PipelinePort) Morph() string {
+	return self.digest
+}
+
+// Must not be called while Pack or Unpack is in progress.
+func (self *PipelinePort) SetSession(pipeline string, packKey, unpackKey []byte) error {
+	var spec *pass.Spec
+	for _, s := range self.specs {
+		if s.String() == pipeline {
+			spec = s
+			break
+		}
+	}
+	if spec == nil {
+		return core.Tr(fmt.Errorf("Pipeline %q is not supported", pipeline))
+	}
+	seal, err := pass.NewAEAD(packKey)
+	if err != nil {
+		return core.Tr(err)
+	}
+	open, err := pass.NewAEAD(unpackKey)
+	if err != nil {
+		return core.Tr(err)
+	}
+	// Keys of the cipher and the codec are kept apart.
+	self.codec.Pass, _ = spec.Build(pass.DeriveKey(packKey, nil, "bxrx codec"))
+	_, self.decodec.Pass = spec.Build(pass.DeriveKey(unpackKey, nil, "bxrx codec"))
+	self.seal.AEAD = seal
+	self.open.AEAD = open
+	self.morph.on = self.morph.morph != nil
+	self.demorph.on = self.demorph.morph != nil
+	return nil
+}
+
+// StreamPipelinePort is the PipelinePort of the chunked carrier, which
+// unpacks frames as streams.
+type StreamPipelinePort struct {
+	*PipelinePort
+	stream *core.StreamNetPort
+}
+
+func (self *StreamPipelinePort) UnpackTo(w io.Writer) error {
+	return self.stream.UnpackTo(w)
 }
 
 type HTTP500WrapPass struct {
@@ -2,9 +2,14 @@ package relayer
 
 import (
 	"bytes"
+	"crypto/rand"
+	"net"
 	"strings"
 	"sync"
 	"testing"
+
+	"github.com/bzEq/bxrx/core"
+	"github.com/bzEq/bxrx/pass"
 )
 
 func TestHTTPInternalError(t *testing.T) {
@@ -23,3 +28,60 @@ func TestHTTPInternalError(t *testing.T) {
 		t.Fail()
 	}
 }
+
+type writeCounter struct {
+	bytes.Buffer
+	max, n int
+}
+
+func (self *writeCounter) Write(p []byte) (int, error) {
+	self.n++
+	if len(p) > self.max {
+		self.max = len(p)
+	}
+	return self.Buffer.Write(p)
+}
+
+func TestChunkedCarrierStreams(t *testing.T) {
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+	pl := &Pipeline{Specs: []*pass.Spec{chunkedSpec}}
+	p, q := pl.FromConn(c0), pl.FromConn(c1)
+	if err := p.(SessionPort).SetSession(chunkedSpec.String(), pass.KeyFromPassphrase("p"), pass.KeyFromPassphrase("q")); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.(SessionPort).SetSession(chunkedSpec.String(), pass.KeyFromPassphrase("q"), pass.KeyFromPassphrase("p")); err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, 5*pass.DEFAULT_RECORD_SIZE+1)
+	rand.Read(frame)
+	go p.Pack(core.FromSlice(append([]byte(nil), frame...)))
+	w := &writeCounter{}
+	if err := q.(core.StreamPort).UnpackTo(w); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(w.Bytes(), frame) {
+		t.Fatal("Frame is corrupted")
+	}
+	if w.n != 6 || w.max > pass.DEFAULT_RECORD_SIZE {
+		t.Fatal(w.n, "writes, at most", w.max, "bytes")
+	}
+}
+
+func TestHandshakeCodec(t *testing.T) {
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+	pl := &Pipeline{Specs: []*pass.Spec{frameSpec}}
+	go pl.FromConn(c0).Pack(core.FromSlice([]byte(frameSpec.String())))
+	buf := make([]byte, 1<<10)
+	n, err := c1.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Handshake frames run the codec of the default pipeline.
+	if bytes.Contains(buf[:n], []byte(frameSpec.String())) {
+		t.Fatal("Frame is sent in plaintext")
+	}
+}
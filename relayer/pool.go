@@ -0,0 +1,251 @@
+// Copyright (c) 2026 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package relayer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bzEq/bxrx/core"
+)
+
+const DEFAULT_POOL_MAX_IDLE_TIME = 120
+const DEFAULT_POOL_CHECK_INTERVAL = 10
+
+type PoolConfig struct {
+	// Idle connections kept warm.
+	MinIdle int
+	// Misses grow the number of idle connections up to MaxIdle, which decays
+	// to MinIdle while connections are left idle.
+	MaxIdle int
+	// Idle connections are discarded after MaxIdleTime, since middleboxes
+	// might have dropped them silently.
+	MaxIdleTime time.Duration
+	// Idle connections are checked at CheckInterval.
+	CheckInterval time.Duration
+}
+
+func (self *PoolConfig) Validate() error {
+	if self.MinIdle < 0 || self.MaxIdle < self.MinIdle || self.MaxIdle == 0 {
+		return fmt.Errorf("Pool must satisfy 0 <= min idle <= max idle and max idle > 0, got %d and %d", self.MinIdle, self.MaxIdle)
+	}
+	if self.MaxIdleTime <= 0 || self.CheckInterval <= 0 {
+		return fmt.Errorf("Max idle time and check interval of pool must be positive")
+	}
+	return nil
+}
+
+type PoolStats struct {
+	Idle int
+	// Dials served by idle connections.
+	Hits uint64
+	// Dials finding no idle connection.
+	Misses uint64
+	// Idle connections found stale.
+	Discarded uint64
+}
+
+// probeConn can be probed without consuming bytes.
+type probeConn struct {
+	net.Conn
+	rbuf *bufio.Reader
+}
+
+func newProbeConn(c net.Conn) *probeConn {
+	return &probeConn{c, bufio.NewReader(c)}
+}
+
+func (self *probeConn) Read(p []byte) (int, error) {
+	return self.rbuf.Read(p)
+}
+
+// Must not be called while the connection is being read. Bytes arrived, e.g.,
+// chaff, are kept.
+func (self *probeConn) alive() bool {
+	if err := self.Conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	_, err := self.rbuf.Peek(1)
+	if err := self.Conn.SetReadDeadline(time.Time{}); err != nil {
+		return false
+	}
+	return err == nil || errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// A connection whose session is established but no request is sent yet.
+type warmConn struct {
+	c *probeConn
+	p core.Port
+	// The protocol version agreed with the peer.
+	version int
+	since   time.Time
+}
+
+type connPool struct {
+	config PoolConfig
+	name   string
+	dial   func() (*warmConn, error)
+	mu     sync.Mutex
+	idle   []*warmConn
+	// Idle connections to keep, from MinIdle to MaxIdle.
+	target  int
+	dialing int
+	// Whether any idle connection is taken since the last check.
+	taken     bool
+	hits      uint64
+	misses    uint64
+	discarded uint64
+	closed    bool
+	done      chan struct{}
+}
+
+func newConnPool(config PoolConfig, name string, dial func() (*warmConn, error)) *connPool {
+	self := &connPool{
+		config: config,
+		name:   name,
+		dial:   dial,
+		target: config.MinIdle,
+		done:   make(chan struct{}),
+	}
+	self.fill()
+	go self.run()
+	return self
+}
+
+// Dials in background until there are target idle connections.
+func (self *connPool) fill() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.closed {
+		return
+	}
+	for ; len(self.idle)+self.dialing < self.target; self.dialing++ {
+		go self.warm()
+	}
+}
+
+func (self *connPool) warm() {
+	w, err := self.dial()
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.dialing--
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if self.closed {
+		w.p.Close()
+		return
+	}
+	self.idle = append(self.idle, w)
+}
+
+// Returns nil if no idle connection is left. The newest one is taken, since
+// it's the least likely to be stale.
+func (self *connPool) get() *warmConn {
+	self.mu.Lock()
+	var w *warmConn
+	if n := len(self.idle); n != 0 {
+		w = self.idle[n-1]
+		self.idle = self.idle[:n-1]
+		self.taken = true
+		self.hits++
+	} else {
+		self.misses++
+		if self.target < self.config.MaxIdle {
+			self.target++
+		}
+	}
+	self.mu.Unlock()
+	self.fill()
+	return w
+}
+
+func (self *connPool) stats() PoolStats {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return PoolStats{
+		Idle:      len(self.idle),
+		Hits:      self.hits,
+		Misses:    self.misses,
+		Discarded: self.discarded,
+	}
+}
+
+// Stale connections are taken out of the pool before being probed, so they
+// are not handed out meanwhile.
+func (self *connPool) check() {
+	self.mu.Lock()
+	idle := self.idle
+	self.idle = nil
+	if !self.taken && self.target > self.config.MinIdle {
+		self.target--
+	}
+	self.taken = false
+	self.mu.Unlock()
+	var alive []*warmConn
+	discarded := uint64(0)
+	for _, w := range idle {
+		if time.Since(w.since) > self.config.MaxIdleTime || !w.c.alive() {
+			discarded++
+			w.p.Close()
+			continue
+		}
+		alive = append(alive, w)
+	}
+	self.mu.Lock()
+	self.discarded += discarded
+	if self.closed {
+		for _, w := range alive {
+			w.p.Close()
+		}
+		self.mu.Unlock()
+		return
+	}
+	// Connections warmed meanwhile are newer.
+	self.idle = append(alive, self.idle...)
+	for len(self.idle) > self.target {
+		self.idle[0].p.Close()
+		self.idle = self.idle[1:]
+	}
+	self.mu.Unlock()
+	self.fill()
+}
+
+func (self *connPool) run() {
+	ticker := time.NewTicker(self.config.CheckInterval)
+	defer ticker.Stop()
+	var last PoolStats
+	for {
+		select {
+		case <-self.done:
+			return
+		case <-ticker.C:
+			self.check()
+			if s := self.stats(); s != last {
+				log.Printf("Pool of %s: %d idle, %d hits, %d misses, %d discarded", self.name, s.Idle, s.Hits, s.Misses, s.Discarded)
+				last = s
+			}
+		}
+	}
+}
+
+func (self *connPool) Close() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.closed {
+		return
+	}
+	self.closed = true
+	close(self.done)
+	for _, w := range self.idle {
+		w.p.Close()
+	}
+	self.idle = nil
+}
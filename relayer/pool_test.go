@@ -0,0 +1,160 @@
+package relayer
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bzEq/bxrx/core"
+	"github.com/bzEq/bxrx/pass"
+)
+
+func TestProbeConn(t *testing.T) {
+	c0, c1 := net.Pipe()
+	pc := newProbeConn(c0)
+	if !pc.alive() {
+		t.Fatal("Idle connection is not alive")
+	}
+	go c1.Write([]byte("hello"))
+	time.Sleep(10 * time.Millisecond)
+	if !pc.alive() {
+		t.Fatal("Connection with pending bytes is not alive")
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(pc, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("Probing consumed bytes")
+	}
+	c1.Close()
+	if pc.alive() {
+		t.Fatal("Closed connection is alive")
+	}
+}
+
+func TestPoolConfig(t *testing.T) {
+	for _, c := range []PoolConfig{
+		{MinIdle: 2, MaxIdle: 1, MaxIdleTime: time.Second, CheckInterval: time.Second},
+		{MinIdle: 0, MaxIdle: 0, MaxIdleTime: time.Second, CheckInterval: time.Second},
+		{MinIdle: 1, MaxIdle: 1},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Fatal(c)
+		}
+	}
+}
+
+// Keeps accepted connections.
+type keepingListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (self *keepingListener) Accept() (net.Conn, error) {
+	c, err := self.Listener.Accept()
+	if err == nil {
+		self.mu.Lock()
+		self.conns = append(self.conns, c)
+		self.mu.Unlock()
+	}
+	return c, err
+}
+
+func (self *keepingListener) closeConns() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for _, c := range self.conns {
+		c.Close()
+	}
+	self.conns = nil
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Timeout")
+}
+
+func TestWrapPool(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := &keepingListener{Listener: l}
+	defer ln.Close()
+	fe := NewWrapFE(ln, &Pipeline{Specs: []*pass.Spec{frameSpec}})
+	accepted := make(chan core.AcceptResult)
+	go func() {
+		for {
+			ar, ok := <-fe.Accept()
+			if !ok {
+				return
+			}
+			ar.Reply(nil, nil)
+			accepted <- ar
+		}
+	}()
+	be := NewWrapBE(ln.Addr().String(), &Pipeline{Specs: []*pass.Spec{frameSpec}})
+	be.EnablePool(PoolConfig{MinIdle: 2, MaxIdle: 3, MaxIdleTime: time.Minute, CheckInterval: 20 * time.Millisecond})
+	defer be.Close()
+	waitFor(t, func() bool { return be.PoolStats().Idle == 2 })
+	dr, ok := <-be.Dial(core.NETWORK_TCP, "example.com:80")
+	if !ok || dr.Err != nil {
+		t.Fatal("Dialing failed", dr.Err)
+	}
+	ar := <-accepted
+	if ar.Addr != "example.com:80" {
+		t.Fatal(ar.Addr)
+	}
+	go dr.Port.Pack(core.FromSlice([]byte("hello")))
+	var b core.IoVec
+	if err := ar.Port.Unpack(&b); err != nil || string(b.Consume()) != "hello" {
+		t.Fatal(err)
+	}
+	dr.Port.Close()
+	ar.Port.Close()
+	if s := be.PoolStats(); s.Hits != 1 || s.Misses != 0 {
+		t.Fatal(s)
+	}
+	// Stale connections are discarded and replaced.
+	waitFor(t, func() bool { return be.PoolStats().Idle == 2 })
+	ln.closeConns()
+	waitFor(t, func() bool { s := be.PoolStats(); return s.Discarded >= 2 && s.Idle == 2 })
+}
+
+func TestWrapPoolMiss(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fe := NewWrapFE(l, &Pipeline{})
+	go func() {
+		for {
+			ar, ok := <-fe.Accept()
+			if !ok {
+				return
+			}
+			defer ar.Port.Close()
+			ar.Reply(nil, nil)
+		}
+	}()
+	be := NewWrapBE(l.Addr().String(), &Pipeline{})
+	be.EnablePool(PoolConfig{MinIdle: 0, MaxIdle: 1, MaxIdleTime: time.Minute, CheckInterval: time.Minute})
+	defer be.Close()
+	dr, ok := <-be.Dial(core.NETWORK_TCP, "example.com:80")
+	if !ok || dr.Err != nil {
+		t.Fatal("Dialing failed", dr.Err)
+	}
+	defer dr.Port.Close()
+	if s := be.PoolStats(); s.Misses != 1 {
+		t.Fatal(s)
+	}
+	// Misses warm connections up to MaxIdle.
+	waitFor(t, func() bool { return be.PoolStats().Idle == 1 })
+}
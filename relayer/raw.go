@@ -3,31 +3,76 @@
 package relayer
 
 import (
+	"fmt"
 	"log"
 	"net"
+	"time"
 
 	"github.com/bzEq/bxrx/core"
 )
 
 type Options struct {
-	LocalAddr      string
-	LocalHTTPProxy string
-	NextHop        string
+	LocalAddr        string
+	LocalHTTPProxy   string
+	SocksCredentials string
+	NextHop          string
+	Key              string
+	Pipeline         string
+	// Deprecated, carries DEFAULT_PASSES_SPEC by this carrier.
+	Carrier         string
+	WSHost          string
+	WSPath          string
+	Morph           string
+	MorphOverhead   float64
+	Chaff           string
+	ChaffInterval   int
+	ChaffSize       int
+	ChaffBudget     int
+	Mux             bool
+	PoolMinIdle     int
+	PoolMaxIdle     int
+	PoolMaxIdleTime int
+	HTTPTunnel      string
+	TLS             bool
+	TLSCert         string
+	TLSKey          string
+	TLSClientCA     string
+	TLSPin          string
 }
 
 type TCPBE struct{}
 
-func (self *TCPBE) Dial(addr string) (ch chan core.DialResult) {
+// UDP associations are relayed by sessions to their destinations, addr is
+// ignored. BINDs listen for a connection from addr.
+func (self *TCPBE) Dial(network, addr string) (ch chan core.DialResult) {
 	ch = make(chan core.DialResult)
 	go func() {
+		switch network {
+		case core.NETWORK_UDP:
+			log.Println("Relaying UDP association")
+			ch <- core.DialResult{Port: newUDPExit(core.DEFAULT_UDP_TIMEOUT * time.Second)}
+			return
+		case core.NETWORK_BIND:
+			p, err := newBindPort(addr, DEFAULT_BIND_TIMEOUT*time.Second)
+			if err != nil {
+				ch <- core.DialResult{Err: core.NewDialError(addr, err)}
+				return
+			}
+			log.Println("Listening for", addr, "at", p.LocalAddr())
+			ch <- core.DialResult{Port: p, Bound: p.bnd}
+			return
+		case core.NETWORK_TCP, "":
+		default:
+			ch <- core.DialResult{Err: core.NewDialError(addr, core.Tr(fmt.Errorf("%w: %s", core.ErrUnsupportedNetwork, network)))}
+			return
+		}
 		c, err := net.Dial("tcp", addr)
 		if err != nil {
-			log.Println(err)
-			close(ch)
+			ch <- core.DialResult{Err: core.NewDialError(addr, core.Tr(err))}
 			return
 		}
 		log.Println("Relaying to", addr, "at", c.LocalAddr())
-		ch <- core.DialResult{core.NewRawNetPort(c)}
+		ch <- core.DialResult{Port: core.NewRawNetPort(c), Bound: c.LocalAddr()}
 	}()
 	return
 }
@@ -0,0 +1,60 @@
+// Copyright (c) 2026 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package relayer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const DEFAULT_REPLAY_WINDOW = 120
+
+// ReplayCache remembers digests of frames seen within a time window. Frames
+// claiming a time outside the window are rejected, so a digest can be
+// forgotten once the time its frame claims falls out of the window.
+type ReplayCache struct {
+	window time.Duration
+	mu     sync.Mutex
+	seen   map[[sha256.Size]byte]time.Time
+	swept  time.Time
+}
+
+func NewReplayCache(window int) *ReplayCache {
+	return &ReplayCache{
+		window: time.Duration(window) * time.Second,
+		seen:   make(map[[sha256.Size]byte]time.Time),
+		swept:  time.Now(),
+	}
+}
+
+func (self *ReplayCache) sweep(now time.Time) {
+	if now.Sub(self.swept) < self.window {
+		return
+	}
+	for k, expiry := range self.seen {
+		if now.After(expiry) {
+			delete(self.seen, k)
+		}
+	}
+	self.swept = now
+}
+
+// Check records frame which claims to be sent at t. It fails if t is out of
+// the window or frame has been seen.
+func (self *ReplayCache) Check(frame []byte, t time.Time) error {
+	now := time.Now()
+	if d := now.Sub(t); d > self.window || d < -self.window {
+		return fmt.Errorf("Frame sent at %s is out of the replay window", t)
+	}
+	k := sha256.Sum256(frame)
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.sweep(now)
+	if _, in := self.seen[k]; in {
+		return fmt.Errorf("Frame %x is replayed", k[:8])
+	}
+	self.seen[k] = t.Add(self.window)
+	return nil
+}
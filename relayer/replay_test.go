@@ -0,0 +1,32 @@
+package relayer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayCache(t *testing.T) {
+	rc := NewReplayCache(DEFAULT_REPLAY_WINDOW)
+	now := time.Now()
+	if err := rc.Check([]byte("hello"), now); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Check([]byte("world"), now); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Check([]byte("hello"), now); err == nil {
+		t.Fail()
+	}
+}
+
+func TestReplayCacheWindow(t *testing.T) {
+	rc := NewReplayCache(DEFAULT_REPLAY_WINDOW)
+	stale := time.Now().Add(-2 * DEFAULT_REPLAY_WINDOW * time.Second)
+	if err := rc.Check([]byte("hello"), stale); err == nil {
+		t.Fail()
+	}
+	future := time.Now().Add(2 * DEFAULT_REPLAY_WINDOW * time.Second)
+	if err := rc.Check([]byte("hello"), future); err == nil {
+		t.Fail()
+	}
+}
@@ -11,14 +11,16 @@ import (
 
 type Socks5FE struct {
 	ln *net.TCPListener
+	// If not nil, clients must authenticate by username and password.
+	Credentials *socks5.Credentials
 }
 
 func NewSocks5FE(ln *net.TCPListener) *Socks5FE {
-	return &Socks5FE{ln}
+	return &Socks5FE{ln: ln}
 }
 
-func (self *Socks5FE) handshake(c net.Conn) (p core.Port, addr string, err error) {
-	err = socks5.ExchangeMetadata(c)
+func (self *Socks5FE) handshake(c net.Conn) (ar core.AcceptResult, err error) {
+	ar.User, err = socks5.ExchangeMetadata(c, self.Credentials)
 	if err != nil {
 		err = core.Tr(err)
 		return
@@ -31,29 +33,66 @@ func (self *Socks5FE) handshake(c net.Conn) (p core.Port, addr string, err error
 	}
 	switch req.CMD {
 	case socks5.CMD_CONNECT:
-		reply := socks5.Reply{
-			VER:      req.VER,
-			REP:      socks5.REP_SUCC,
-			ATYP:     socks5.ATYP_IPV4,
-			BND_ADDR: make([]byte, net.IPv4len),
+		ar.Addr = socks5.GetDialAddress(req.ATYP, req.DST_ADDR, req.DST_PORT)
+		ar.Port = core.NewRawNetPort(c)
+		ar.Reply = func(bound net.Addr, err error) error {
+			return replyDial(c, bound, err)
 		}
-		socks5.SendReply(c, reply)
-		addr = socks5.GetDialAddress(req.ATYP, req.DST_ADDR, req.DST_PORT)
-		p = core.NewRawNetPort(c)
 		return
-	default:
-		reply := socks5.Reply{
-			VER:      req.VER,
-			REP:      socks5.REP_COMMAND_NOT_SUPPORTED,
-			ATYP:     socks5.ATYP_IPV4,
-			BND_ADDR: make([]byte, net.IPv4len),
+	case socks5.CMD_BIND:
+		ar.Addr = socks5.GetDialAddress(req.ATYP, req.DST_ADDR, req.DST_PORT)
+		ar.Port = core.NewRawNetPort(c)
+		ar.Network = core.NETWORK_BIND
+		// Both replies are sent by the exit once it's listening.
+		ar.Reply = func(bound net.Addr, err error) error {
+			if err != nil {
+				return replyDial(c, bound, err)
+			}
+			return nil
+		}
+		return
+	case socks5.CMD_UDP_ASSOCIATE:
+		var a *udpAssociation
+		a, err = newUDPAssociation(c, req)
+		if err != nil {
+			socks5.SendReply(c, socks5.NewReply(socks5.REP_GENERAL_SERVER_FAILURE, nil))
+			err = core.Tr(err)
+			return
+		}
+		ar.Port = a
+		ar.Network = core.NETWORK_UDP
+		// The relay socket is reported rather than bound.
+		ar.Reply = func(bound net.Addr, err error) error {
+			if err != nil {
+				return replyDial(c, bound, err)
+			}
+			bnd := a.LocalAddr().(*net.UDPAddr)
+			reply := socks5.NewReply(socks5.REP_SUCC, nil)
+			reply.ATYP, reply.BND_ADDR, reply.BND_PORT = socks5.EncodeAddress(bnd.IP, bnd.Port)
+			if err := socks5.SendReply(c, reply); err != nil {
+				return err
+			}
+			go a.watch()
+			return nil
 		}
-		socks5.SendReply(c, reply)
+		return
+	default:
+		socks5.SendReply(c, socks5.NewReply(socks5.REP_COMMAND_NOT_SUPPORTED, nil))
 		err = core.Tr(fmt.Errorf("Unsupported CMD: %d", req.CMD))
 		return
 	}
 }
 
+// Replies the outcome of dialing. bound is reported if it's a TCP address,
+// otherwise a zero address is.
+func replyDial(c net.Conn, bound net.Addr, err error) error {
+	if err != nil {
+		return socks5.SendReply(c, socks5.NewReply(socks5.ReplyOfDialError(err), nil))
+	}
+	bnd, _ := bound.(*net.TCPAddr)
+	return socks5.SendReply(c, socks5.NewReply(socks5.REP_SUCC, bnd))
+}
+
 func (self *Socks5FE) Accept() (ch chan core.AcceptResult) {
 	ch = make(chan core.AcceptResult)
 	c, err := self.ln.Accept()
@@ -63,14 +102,14 @@ func (self *Socks5FE) Accept() (ch chan core.AcceptResult) {
 		return
 	}
 	go func() {
-		p, addr, err := self.handshake(c)
+		ar, err := self.handshake(c)
 		if err != nil {
 			log.Println(err)
 			close(ch)
 			c.Close()
 			return
 		}
-		ch <- core.AcceptResult{p, addr}
+		ch <- ar
 	}()
 	return
 }
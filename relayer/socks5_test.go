@@ -0,0 +1,63 @@
+package relayer
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/bzEq/bxrx/proxy/socks5"
+)
+
+func socks5Connect(t *testing.T, ln *net.TCPListener, addr *net.TCPAddr) (net.Conn, byte, *net.TCPAddr) {
+	go relayOne(NewSocks5FE(ln), &TCPBE{})
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte{socks5.VER, 1, socks5.METHOD_NO_AUTH}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	atyp, a, p := socks5.EncodeAddress(addr.IP, addr.Port)
+	req := append([]byte{socks5.VER, socks5.CMD_CONNECT, 0, atyp}, a...)
+	if _, err := c.Write(append(req, p[:]...)); err != nil {
+		t.Fatal(err)
+	}
+	rep, bnd := readReply(t, c)
+	return c, rep, bnd
+}
+
+func TestSocks5ConnectReply(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dst, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := dst.Addr().(*net.TCPAddr)
+	c, rep, bnd := socks5Connect(t, ln, addr)
+	defer c.Close()
+	if rep != socks5.REP_SUCC {
+		t.Fatal(rep)
+	}
+	accepted, err := dst.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	if bnd.String() != accepted.RemoteAddr().String() {
+		t.Fatal(bnd, accepted.RemoteAddr())
+	}
+	// Nothing listens at addr anymore.
+	dst.Close()
+	c, rep, _ = socks5Connect(t, ln, addr)
+	defer c.Close()
+	if rep != socks5.REP_CONNECTION_REFUSED {
+		t.Fatal(rep)
+	}
+}
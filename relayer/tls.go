@@ -0,0 +1,25 @@
+// Copyright (c) 2026 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package relayer
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/bzEq/bxrx/core"
+)
+
+// TLSPortBuilder secures the connection with TLS before building the port by
+// Next. The TLS handshake is performed on the first read or write.
+type TLSPortBuilder struct {
+	Config *tls.Config
+	Server bool
+	Next   core.PortBuilder
+}
+
+func (self *TLSPortBuilder) FromConn(c net.Conn) core.Port {
+	if self.Server {
+		return self.Next.FromConn(tls.Server(c, self.Config))
+	}
+	return self.Next.FromConn(tls.Client(c, self.Config))
+}
@@ -0,0 +1,427 @@
+// Copyright (c) 2026 Kai Luo <gluokai@gmail.com>. All rights reserved.
+
+package relayer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bzEq/bxrx/core"
+	"github.com/bzEq/bxrx/proxy/socks5"
+)
+
+// Datagrams between relayers are SOCKS5 UDP requests prefixed by their lengths
+// as uvarints, so they survive links not keeping frame boundaries, e.g., mux
+// streams. Requests to the exit carry destinations and replies carry sources.
+const MAX_DATAGRAM_SIZE = 1 << 17
+
+const MAX_UDP_PAYLOAD_SIZE = 64 << 10
+
+// Destinations an association may send to at once.
+const DEFAULT_UDP_SESSIONS = 256
+
+func appendDatagram(b *core.IoVec, d []byte) {
+	b.AppendUvarint(uint64(len(d)))
+	b.Take(d)
+}
+
+// datagramReader splits frames into datagrams. Datagrams longer than
+// MAX_DATAGRAM_SIZE are dropped.
+type datagramReader struct {
+	buf core.IoVec
+	// Bytes of the datagram being dropped yet to skip.
+	skip uint64
+}
+
+// b isn't retained.
+func (self *datagramReader) feed(b *core.IoVec) {
+	if b.Len() != 0 {
+		self.buf.Take(b.Concat())
+	}
+}
+
+// Returns false if no complete datagram is buffered.
+func (self *datagramReader) next() ([]byte, bool, error) {
+	for {
+		if self.skip != 0 {
+			n := uint64(self.buf.Len())
+			if n > self.skip {
+				n = self.skip
+			}
+			self.buf.Skip(int(n))
+			self.skip -= n
+			if self.skip != 0 {
+				return nil, false, nil
+			}
+		}
+		l, err := self.buf.ReadUvarint()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, false, nil
+			}
+			return nil, false, core.Tr(err)
+		}
+		if l == 0 {
+			continue
+		}
+		if l > MAX_DATAGRAM_SIZE {
+			log.Println("Dropping datagram of", l, "bytes")
+			self.skip = l
+			continue
+		}
+		if self.buf.Len() < int(l) {
+			self.buf.PrependUvarint(l)
+			return nil, false, nil
+		}
+		d := self.buf.View(0, int(l)).Concat()
+		self.buf.Skip(int(l))
+		return d, true, nil
+	}
+}
+
+// udpAssociation is the port of a SOCKS5 UDP association. Datagrams the
+// client sends to the relay socket are unpacked, reassembled if fragmented,
+// and packed datagrams are sent back to the client. The association ends with
+// its control connection.
+type udpAssociation struct {
+	ctrl net.Conn
+	conn *net.UDPConn
+	// Datagrams are accepted only from the host of the control connection, and
+	// from port if it's not zero.
+	host   net.IP
+	port   int
+	mu     sync.Mutex
+	client *net.UDPAddr
+	frags  socks5.Reassembler
+	dr     datagramReader
+	buf    []byte
+	once   sync.Once
+}
+
+// The relay socket is bound to the address the control connection is accepted
+// at, which is reachable by the client.
+func newUDPAssociation(ctrl net.Conn, req *socks5.Request) (*udpAssociation, error) {
+	local, ok := ctrl.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, core.Tr(fmt.Errorf("UDP association over %s is not supported", ctrl.LocalAddr().Network()))
+	}
+	remote, ok := ctrl.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, core.Tr(fmt.Errorf("UDP association over %s is not supported", ctrl.RemoteAddr().Network()))
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		return nil, core.Tr(err)
+	}
+	self := &udpAssociation{
+		ctrl: ctrl,
+		conn: conn,
+		host: remote.IP,
+		port: int(binary.BigEndian.Uint16(req.DST_PORT[:])),
+		buf:  make([]byte, MAX_UDP_PAYLOAD_SIZE),
+	}
+	// Larger datagrams can't be sent by the exit.
+	self.frags.Max = MAX_UDP_PAYLOAD_SIZE
+	return self, nil
+}
+
+// Closes the association once the control connection is closed.
+func (self *udpAssociation) watch() {
+	self.ctrl.SetReadDeadline(time.Time{})
+	io.Copy(io.Discard, self.ctrl)
+	self.Close()
+}
+
+// The first datagram accepted tells the address of the client.
+func (self *udpAssociation) accept(from *net.UDPAddr) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.client != nil {
+		return from.IP.Equal(self.client.IP) && from.Port == self.client.Port
+	}
+	if !from.IP.Equal(self.host) || (self.port != 0 && from.Port != self.port) {
+		return false
+	}
+	self.client = from
+	return true
+}
+
+func (self *udpAssociation) peer() *net.UDPAddr {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.client
+}
+
+func (self *udpAssociation) Unpack(b *core.IoVec) error {
+	for {
+		n, from, err := self.conn.ReadFromUDP(self.buf)
+		if err != nil {
+			return core.Tr(err)
+		}
+		if !self.accept(from) {
+			log.Println("Dropping datagram from", from, "to", self.conn.LocalAddr())
+			continue
+		}
+		var req socks5.UDPRequest
+		if err := socks5.ParseUDPRequest(self.buf[:n], &req); err != nil {
+			log.Println(err)
+			continue
+		}
+		if req.FRAG != 0 {
+			// Fragments are retained while buf is reused.
+			req.DATA = append([]byte(nil), req.DATA...)
+		}
+		if r := self.frags.Add(&req); r != nil {
+			appendDatagram(b, r.Bytes())
+			return nil
+		}
+	}
+}
+
+// Datagrams are dropped until the client sends one.
+func (self *udpAssociation) Pack(b *core.IoVec) error {
+	self.dr.feed(b)
+	for {
+		d, ok, err := self.dr.next()
+		if err != nil || !ok {
+			return err
+		}
+		client := self.peer()
+		if client == nil {
+			continue
+		}
+		if _, err := self.conn.WriteToUDP(d, client); err != nil {
+			return core.Tr(err)
+		}
+	}
+}
+
+func (self *udpAssociation) CloseRead() error {
+	return nil
+}
+
+// UDP can't be half closed, so the association ends.
+func (self *udpAssociation) CloseWrite() error {
+	return self.Close()
+}
+
+func (self *udpAssociation) Close() error {
+	var err error
+	self.once.Do(func() {
+		err = self.conn.Close()
+		self.ctrl.Close()
+	})
+	return err
+}
+
+func (self *udpAssociation) LocalAddr() net.Addr {
+	return self.conn.LocalAddr()
+}
+
+func (self *udpAssociation) RemoteAddr() net.Addr {
+	return self.ctrl.RemoteAddr()
+}
+
+type udpSession struct {
+	conn *net.UDPConn
+	// Unix time in nanoseconds of the last datagram in either direction.
+	last atomic.Int64
+}
+
+func (self *udpSession) touch() {
+	self.last.Store(time.Now().UnixNano())
+}
+
+func (self *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, self.last.Load()))
+}
+
+// udpExit relays datagrams of an association to their destinations. Every
+// destination has a session, i.e., a connected socket, which is closed once
+// it's idle for the timeout. Replies are unpacked with their sources.
+type udpExit struct {
+	timeout  time.Duration
+	dr       datagramReader
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+	closed   bool
+	recv     chan []byte
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newUDPExit(timeout time.Duration) *udpExit {
+	return &udpExit{
+		timeout:  timeout,
+		sessions: make(map[string]*udpSession),
+		recv:     make(chan []byte, DEFAULT_UDP_SESSIONS),
+		done:     make(chan struct{}),
+	}
+}
+
+func (self *udpExit) numSessions() int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return len(self.sessions)
+}
+
+// Sessions are only created by Pack, so the destination is dialed without
+// holding the lock.
+func (self *udpExit) session(addr string) (*udpSession, error) {
+	self.mu.Lock()
+	s, n := self.sessions[addr], len(self.sessions)
+	self.mu.Unlock()
+	if s != nil {
+		return s, nil
+	}
+	if n >= DEFAULT_UDP_SESSIONS {
+		return nil, core.Tr(fmt.Errorf("Too many UDP sessions, dropping datagram to %s", addr))
+	}
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, core.Tr(err)
+	}
+	s = &udpSession{conn: c.(*net.UDPConn)}
+	s.touch()
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.closed {
+		c.Close()
+		return nil, core.Tr(net.ErrClosed)
+	}
+	self.sessions[addr] = s
+	go self.read(addr, s)
+	return s, nil
+}
+
+func (self *udpExit) remove(addr string, s *udpSession) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.sessions[addr] == s {
+		delete(self.sessions, addr)
+	}
+	s.conn.Close()
+}
+
+func (self *udpExit) read(addr string, s *udpSession) {
+	defer self.remove(addr, s)
+	raddr := s.conn.RemoteAddr().(*net.UDPAddr)
+	atyp, a, p := socks5.EncodeAddress(raddr.IP, raddr.Port)
+	hdr := (&socks5.UDPRequest{ATYP: atyp, DST_ADDR: a, DST_PORT: p}).Header()
+	buf := make([]byte, MAX_UDP_PAYLOAD_SIZE)
+	for {
+		s.conn.SetReadDeadline(time.Unix(0, s.last.Load()).Add(self.timeout))
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				if s.idle() < self.timeout {
+					continue
+				}
+				log.Println("UDP session to", addr, "is idle")
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// E.g., ICMP port unreachable.
+			log.Println(err)
+			continue
+		}
+		s.touch()
+		d := append(append(make([]byte, 0, len(hdr)+n), hdr...), buf[:n]...)
+		select {
+		case self.recv <- d:
+		case <-self.done:
+			return
+		}
+	}
+}
+
+// Fragments are reassembled by the entry, so they are not expected.
+func (self *udpExit) Pack(b *core.IoVec) error {
+	self.dr.feed(b)
+	for {
+		d, ok, err := self.dr.next()
+		if err != nil || !ok {
+			return err
+		}
+		var req socks5.UDPRequest
+		if err := socks5.ParseUDPRequest(d, &req); err != nil {
+			return core.Tr(err)
+		}
+		if req.FRAG != 0 {
+			log.Println("Dropping UDP fragment", req.FRAG)
+			continue
+		}
+		if len(req.DATA) > MAX_UDP_PAYLOAD_SIZE {
+			log.Println("Dropping UDP payload of", len(req.DATA), "bytes")
+			continue
+		}
+		addr := socks5.GetDialAddress(req.ATYP, req.DST_ADDR, req.DST_PORT)
+		s, err := self.session(addr)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		s.touch()
+		if _, err := s.conn.Write(req.DATA); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Replies pending are unpacked together.
+func (self *udpExit) Unpack(b *core.IoVec) error {
+	select {
+	case d := <-self.recv:
+		appendDatagram(b, d)
+	case <-self.done:
+		return core.Tr(io.EOF)
+	}
+	for {
+		select {
+		case d := <-self.recv:
+			appendDatagram(b, d)
+		default:
+			return nil
+		}
+	}
+}
+
+func (self *udpExit) CloseRead() error {
+	return nil
+}
+
+// UDP can't be half closed, so the association ends.
+func (self *udpExit) CloseWrite() error {
+	return self.Close()
+}
+
+func (self *udpExit) Close() error {
+	self.once.Do(func() {
+		self.mu.Lock()
+		defer self.mu.Unlock()
+		self.closed = true
+		close(self.done)
+		for _, s := range self.sessions {
+			s.conn.Close()
+		}
+	})
+	return nil
+}
+
+func (self *udpExit) LocalAddr() net.Addr {
+	return &net.UDPAddr{}
+}
+
+func (self *udpExit) RemoteAddr() net.Addr {
+	return &net.UDPAddr{}
+}
@@ -0,0 +1,220 @@
+package relayer
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bzEq/bxrx/core"
+	"github.com/bzEq/bxrx/pass"
+	"github.com/bzEq/bxrx/proxy/socks5"
+)
+
+func TestDatagramReader(t *testing.T) {
+	var b core.IoVec
+	appendDatagram(&b, []byte("hello"))
+	appendDatagram(&b, bytes.Repeat([]byte{1}, 300))
+	frame := b.Concat()
+	var dr datagramReader
+	var got [][]byte
+	// Feed byte by byte, so lengths and datagrams are truncated.
+	for i := range frame {
+		dr.feed(core.FromSlice(frame[i : i+1]))
+		for {
+			d, ok, err := dr.next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				break
+			}
+			got = append(got, d)
+		}
+	}
+	if len(got) != 2 || string(got[0]) != "hello" || len(got[1]) != 300 {
+		t.Fatal(got)
+	}
+}
+
+func TestDatagramReaderDropsOversized(t *testing.T) {
+	var b core.IoVec
+	appendDatagram(&b, make([]byte, MAX_DATAGRAM_SIZE+1))
+	appendDatagram(&b, []byte("hello"))
+	frame := b.Concat()
+	var dr datagramReader
+	var got [][]byte
+	for len(frame) != 0 {
+		n := len(frame)
+		if n > 1000 {
+			n = 1000
+		}
+		dr.feed(core.FromSlice(frame[:n]))
+		frame = frame[n:]
+		for {
+			d, ok, err := dr.next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				break
+			}
+			got = append(got, d)
+		}
+	}
+	if len(got) != 1 || string(got[0]) != "hello" {
+		t.Fatal(len(got))
+	}
+}
+
+func startUDPEcho(t *testing.T) *net.UDPConn {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, MAX_UDP_PAYLOAD_SIZE)
+		for {
+			n, from, err := c.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			c.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return c
+}
+
+// Relays one connection accepted by fe through be.
+func relayOne(fe core.Frontend, be core.Backend) {
+	if ar, ok := <-fe.Accept(); ok {
+		core.NewRelayer(fe, be).Handle(ar)
+	}
+}
+
+// Returns the relay socket of the association.
+func associate(t *testing.T, ctrl net.Conn) *net.UDPAddr {
+	if _, err := ctrl.Write([]byte{socks5.VER, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	var buf [10]byte
+	if _, err := io.ReadFull(ctrl, buf[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctrl.Write([]byte{socks5.VER, socks5.CMD_UDP_ASSOCIATE, 0, socks5.ATYP_IPV4, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(ctrl, buf[:]); err != nil {
+		t.Fatal(err)
+	}
+	if buf[1] != socks5.REP_SUCC || buf[3] != socks5.ATYP_IPV4 {
+		t.Fatal(buf)
+	}
+	return &net.UDPAddr{IP: net.IP(buf[4:8]), Port: int(buf[8])<<8 | int(buf[9])}
+}
+
+func udpRequest(dst *net.UDPAddr, frag byte, data []byte) []byte {
+	atyp, addr, port := socks5.EncodeAddress(dst.IP, dst.Port)
+	req := socks5.UDPRequest{FRAG: frag, ATYP: atyp, DST_ADDR: addr, DST_PORT: port, DATA: data}
+	return req.Bytes()
+}
+
+func testUDPAssociate(t *testing.T, mux bool) {
+	echo := startUDPEcho(t)
+	defer echo.Close()
+	wln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wln.Close()
+	fe := NewWrapFE(wln, &Pipeline{Specs: []*pass.Spec{frameSpec}})
+	be := NewWrapBE(wln.Addr().String(), &Pipeline{Specs: []*pass.Spec{frameSpec}})
+	be.Mux = mux
+	defer be.Close()
+	sln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sln.Close()
+	go relayOne(NewSocks5FE(sln), be)
+	go relayOne(fe, &TCPBE{})
+	ctrl, err := net.Dial("tcp", sln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	relay := associate(t, ctrl)
+	c, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	dst := echo.LocalAddr().(*net.UDPAddr)
+	expect := func(data []byte) {
+		buf := make([]byte, MAX_UDP_PAYLOAD_SIZE)
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reply socks5.UDPRequest
+		if err := socks5.ParseUDPRequest(buf[:n], &reply); err != nil {
+			t.Fatal(err)
+		}
+		if src := socks5.GetDialAddress(reply.ATYP, reply.DST_ADDR, reply.DST_PORT); src != dst.String() {
+			t.Fatal(src)
+		}
+		if !bytes.Equal(reply.DATA, data) {
+			t.Fatal(string(reply.DATA))
+		}
+	}
+	if _, err := c.Write(udpRequest(dst, 0, []byte("ping"))); err != nil {
+		t.Fatal(err)
+	}
+	expect([]byte("ping"))
+	c.Write(udpRequest(dst, 1, []byte("frag")))
+	c.Write(udpRequest(dst, 2, []byte("ment")))
+	c.Write(udpRequest(dst, 0x83, []byte("ed")))
+	expect([]byte("fragmented"))
+	// Closing the control connection ends the association.
+	ctrl.Close()
+	waitFor(t, func() bool {
+		c.Write(udpRequest(dst, 0, []byte("ping")))
+		c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		_, err := c.Read(make([]byte, MAX_UDP_PAYLOAD_SIZE))
+		return err != nil
+	})
+}
+
+func TestUDPAssociate(t *testing.T) {
+	testUDPAssociate(t, false)
+}
+
+func TestUDPAssociateMux(t *testing.T) {
+	testUDPAssociate(t, true)
+}
+
+func TestUDPExitTimeout(t *testing.T) {
+	echo := startUDPEcho(t)
+	defer echo.Close()
+	exit := newUDPExit(50 * time.Millisecond)
+	defer exit.Close()
+	var b core.IoVec
+	appendDatagram(&b, udpRequest(echo.LocalAddr().(*net.UDPAddr), 0, []byte("ping")))
+	if err := exit.Pack(&b); err != nil {
+		t.Fatal(err)
+	}
+	var r core.IoVec
+	if err := exit.Unpack(&r); err != nil {
+		t.Fatal(err)
+	}
+	if exit.numSessions() != 1 {
+		t.Fatal(exit.numSessions())
+	}
+	waitFor(t, func() bool { return exit.numSessions() == 0 })
+	exit.CloseWrite()
+	if err := exit.Unpack(&r); err == nil {
+		t.Fail()
+	}
+}
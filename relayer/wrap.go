@@ -1,108 +1,683 @@
 package relayer
 
 import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/bzEq/bxrx/core"
+	"github.com/bzEq/bxrx/pass"
 	"github.com/bzEq/bxrx/proxy/wrap"
 )
 
+// Ports built by the PortBuilder of WrapFE and WrapBE must accept the session
+// agreed by peers, i.e., a mutually supported pipeline and keys derived from an
+// ephemeral key exchange of each connection.
+type SessionPort interface {
+	core.Port
+	// Canonical specs of supported pipelines, in order of preference.
+	Pipelines() []string
+	// Digest of the size distribution frames are morphed to, empty if frames
+	// aren't morphed.
+	Morph() string
+	SetSession(pipeline string, packKey, unpackKey []byte) error
+}
+
+func asSessionPort(p core.Port) (SessionPort, error) {
+	sp, ok := p.(SessionPort)
+	if !ok {
+		return nil, fmt.Errorf("%T doesn't support sessions", p)
+	}
+	return sp, nil
+}
+
+// Picks the first offered pipeline that is supported.
+func negotiate(hello *wrap.Hello, supported []string) (version int, pipeline string, err error) {
+	if hello.Version < wrap.MIN_VERSION {
+		err = fmt.Errorf("Protocol version %d is not supported, expecting %d to %d", hello.Version, wrap.MIN_VERSION, wrap.VERSION)
+		return
+	}
+	version = hello.Version
+	if version > wrap.VERSION {
+		version = wrap.VERSION
+	}
+	for _, p := range hello.Pipelines {
+		for _, q := range supported {
+			if p == q {
+				pipeline = p
+				return
+			}
+		}
+	}
+	err = fmt.Errorf("No common pipeline, offered [%s], supported [%s]", strings.Join(hello.Pipelines, "; "), strings.Join(supported, "; "))
+	return
+}
+
+// Keys of both directions are derived from the shared secret, salted with
+// public keys of the dialing peer (client) and the accepting peer (server).
+func deriveSessionKeys(priv *ecdh.PrivateKey, peerPub []byte, client bool) (packKey, unpackKey []byte, err error) {
+	pub, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return
+	}
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return
+	}
+	var salt []byte
+	if client {
+		salt = append(append(salt, priv.PublicKey().Bytes()...), peerPub...)
+	} else {
+		salt = append(append(salt, peerPub...), priv.PublicKey().Bytes()...)
+	}
+	c2s := pass.DeriveKey(secret, salt, "bxrx c2s")
+	s2c := pass.DeriveKey(secret, salt, "bxrx s2c")
+	if client {
+		return c2s, s2c, nil
+	}
+	return s2c, c2s, nil
+}
+
 type WrapFE struct {
-	ln *net.TCPListener
-	pb core.PortBuilder
+	ln      net.Listener
+	pb      core.PortBuilder
+	replay  *ReplayCache
+	once    sync.Once
+	results chan core.AcceptResult
+	// Closed once the listener is closed.
+	done chan struct{}
+	// If not nil, chaff is sent to peers speaking wrap.CHAFF_VERSION.
+	Chaff *core.ChaffConfig
+	// Caps the protocol version agreed if not zero, e.g., to speak as older
+	// peers.
+	version int
 }
 
-func NewWrapFE(ln *net.TCPListener, pb core.PortBuilder) *WrapFE {
-	return &WrapFE{ln, pb}
+func NewWrapFE(ln net.Listener, pb core.PortBuilder) *WrapFE {
+	return &WrapFE{
+		ln:      ln,
+		pb:      pb,
+		replay:  NewReplayCache(DEFAULT_REPLAY_WINDOW),
+		results: make(chan core.AcceptResult),
+		done:    make(chan struct{}),
+	}
 }
 
-func (self *WrapFE) handshake(c net.Conn) (p core.Port, addr string, err error) {
-	p = self.pb.FromConn(c)
+// Returns the protocol version agreed with the peer and whether streams are
+// multiplexed.
+func (self *WrapFE) exchangeKeys(p SessionPort) (int, bool, error) {
 	var b core.IoVec
-	err = p.Unpack(&b)
+	if err := p.Unpack(&b); err != nil {
+		return 0, false, core.Tr(err)
+	}
+	frame := b.Consume()
+	var hello wrap.Hello
+	if err := gob.NewDecoder(bytes.NewReader(frame)).Decode(&hello); err != nil {
+		return 0, false, core.Tr(err)
+	}
+	if err := self.replay.Check(frame, time.Unix(hello.Time, 0)); err != nil {
+		return 0, false, core.Tr(err)
+	}
+	rpc := &core.GobRPC{P: p}
+	version, pipeline, err := negotiate(&hello, p.Pipelines())
+	if self.version != 0 && version > self.version {
+		version = self.version
+	}
+	if err == nil && hello.Morph != p.Morph() {
+		err = fmt.Errorf("Morphing mismatches, relayers on both ends must morph frames to the same size distribution")
+	}
+	if err != nil {
+		rpc.SendResponse(&wrap.HelloReply{Version: wrap.VERSION, Error: err.Error()})
+		return 0, false, core.Tr(err)
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return 0, false, core.Tr(err)
+	}
+	packKey, unpackKey, err := deriveSessionKeys(priv, hello.PublicKey, false)
+	if err != nil {
+		return 0, false, core.Tr(err)
+	}
+	reply := wrap.HelloReply{
+		Version:   version,
+		PublicKey: priv.PublicKey().Bytes(),
+		Pipeline:  pipeline,
+		Mux:       hello.Mux && version >= wrap.MUX_VERSION,
+	}
+	if err := rpc.SendResponse(&reply); err != nil {
+		return 0, false, core.Tr(err)
+	}
+	return version, reply.Mux, core.Tr(p.SetSession(pipeline, packKey, unpackKey))
+}
+
+// Peers before wrap.LEADING_MARK_VERSION mark frames by a trailing byte.
+func newChaffPort(p core.Port, config *core.ChaffConfig, version int) *core.ChaffPort {
+	if version < wrap.LEADING_MARK_VERSION {
+		return core.NewTrailingChaffPort(p, config)
+	}
+	return core.NewChaffPort(p, config)
+}
+
+func encodeRequest(req *wrap.TCPRequest) (*core.IoVec, error) {
+	var b core.IoVec
+	if err := gob.NewEncoder(&b).Encode(req); err != nil {
+		return nil, core.Tr(err)
+	}
+	return &b, nil
+}
+
+func decodeRequest(b *core.IoVec) (req wrap.TCPRequest, err error) {
+	err = core.Tr(gob.NewDecoder(b).Decode(&req))
+	return
+}
+
+// Bytes unpacked ahead are unpacked first.
+type readAheadPort struct {
+	core.Port
+	ahead core.IoVec
+}
+
+func (self *readAheadPort) Unpack(b *core.IoVec) error {
+	if self.ahead.Len() != 0 {
+		b.Append(&self.ahead)
+		self.ahead = core.IoVec{}
+		return nil
+	}
+	return self.Port.Unpack(b)
+}
+
+const MAX_RESPONSE_SIZE = 4 << 10
+
+func newResponse(bound net.Addr, err error) *wrap.TCPResponse {
+	resp := &wrap.TCPResponse{Status: wrap.STATUS_OK}
+	if bound != nil {
+		resp.Bound = bound.String()
+	}
+	if err == nil {
+		return resp
+	}
+	resp.Status = wrap.STATUS_DIAL_FAILED
+	resp.Class = core.ClassifyDialError(err)
+	if resp.Class == core.DIAL_ERROR_UNSUPPORTED_NETWORK {
+		resp.Status = wrap.STATUS_BAD_REQUEST
+	}
+	// Locations traced by core.Tr are not told to the peer.
+	resp.Error = err.Error()
+	var oe *net.OpError
+	if errors.As(err, &oe) {
+		resp.Error = oe.Error()
+	}
+	return resp
+}
+
+func writeResponse(p core.Port, resp *wrap.TCPResponse) error {
+	var b core.IoVec
+	if err := gob.NewEncoder(&b).Encode(resp); err != nil {
+		return core.Tr(err)
+	}
+	b.PrependUvarint(uint64(b.Len()))
+	return core.Tr(p.Pack(&b))
+}
+
+// Bytes following the response are kept by the returned port.
+func readResponse(p core.Port) (*wrap.TCPResponse, core.Port, error) {
+	var b core.IoVec
+	var l uint64
+	for {
+		var err error
+		l, err = b.ReadUvarint()
+		if err == nil {
+			if l > MAX_RESPONSE_SIZE {
+				return nil, nil, core.Tr(fmt.Errorf("Response length %d is abnormal", l))
+			}
+			if uint64(b.Len()) >= l {
+				break
+			}
+			b.PrependUvarint(l)
+		} else if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, nil, core.Tr(err)
+		}
+		var frame core.IoVec
+		if err := p.Unpack(&frame); err != nil {
+			return nil, nil, core.Tr(err)
+		}
+		b.Append(&frame)
+	}
+	msg := b.View(0, int(l))
+	b.Skip(int(l))
+	var resp wrap.TCPResponse
+	if err := gob.NewDecoder(bytes.NewReader(msg.Concat())).Decode(&resp); err != nil {
+		return nil, nil, core.Tr(err)
+	}
+	if b.Len() != 0 {
+		return &resp, &readAheadPort{p, b}, nil
+	}
+	return &resp, p, nil
+}
+
+// Returns nil if the peer doesn't expect responses.
+func responder(p core.Port, version int) func(net.Addr, error) error {
+	if version < wrap.RESPONSE_VERSION {
+		return nil
+	}
+	return func(bound net.Addr, err error) error {
+		return writeResponse(p, newResponse(bound, err))
+	}
+}
+
+// If the peer multiplexes streams, mux is returned instead of the request.
+func (self *WrapFE) handshake(c net.Conn) (p core.Port, version int, req wrap.TCPRequest, mux *core.Mux, err error) {
+	sp, err := asSessionPort(self.pb.FromConn(c))
+	if err != nil {
+		err = core.Tr(err)
+		return
+	}
+	p = sp
+	version, muxed, err := self.exchangeKeys(sp)
 	if err != nil {
 		err = core.Tr(err)
 		return
 	}
-	dec := gob.NewDecoder(&b)
-	var req wrap.TCPRequest
-	err = dec.Decode(&req)
+	if version >= wrap.CHAFF_VERSION {
+		p = newChaffPort(sp, self.Chaff, version)
+	}
+	if muxed {
+		mux = core.NewMux(p, false)
+		return
+	}
+	var b core.IoVec
+	err = p.Unpack(&b)
 	if err != nil {
 		err = core.Tr(err)
 		return
 	}
-	addr = req.Addr
+	req, err = decodeRequest(&b)
 	return
 }
 
-func (self *WrapFE) Accept() (ch chan core.AcceptResult) {
-	ch = make(chan core.AcceptResult)
-	c, err := self.ln.Accept()
+// Connections are accepted and handshaken in background.
+func (self *WrapFE) serve() {
+	for {
+		c, err := self.ln.Accept()
+		if err != nil {
+			log.Println(err)
+			if errors.Is(err, net.ErrClosed) {
+				close(self.done)
+				return
+			}
+			continue
+		}
+		go self.serveConn(c)
+	}
+}
+
+func (self *WrapFE) serveConn(c net.Conn) {
+	p, version, req, mux, err := self.handshake(c)
 	if err != nil {
 		log.Println(err)
-		close(ch)
+		c.Close()
 		return
 	}
-	go func() {
-		p, addr, err := self.handshake(c)
+	if mux == nil {
+		self.deliver(core.AcceptResult{Port: p, Addr: req.Addr, Network: req.Network, Reply: responder(p, version)})
+		return
+	}
+	defer mux.Close()
+	for {
+		s, err := mux.Accept()
 		if err != nil {
 			log.Println(err)
-			close(ch)
-			c.Close()
 			return
 		}
-		ch <- core.AcceptResult{p, addr}
-	}()
+		req, err := decodeRequest(core.FromSlice(s.Header))
+		if err != nil {
+			log.Println(err)
+			s.Close()
+			continue
+		}
+		if !self.deliver(core.AcceptResult{Port: s, Addr: req.Addr, Network: req.Network, Reply: responder(s, version)}) {
+			return
+		}
+	}
+}
+
+// The port is closed if it's not accepted before the listener is closed.
+func (self *WrapFE) deliver(ar core.AcceptResult) bool {
+	select {
+	case self.results <- ar:
+		return true
+	case <-self.done:
+		ar.Port.Close()
+		return false
+	}
+}
+
+// Streams of multiplexed connections are accepted as they are opened.
+func (self *WrapFE) Accept() (ch chan core.AcceptResult) {
+	self.once.Do(func() { go self.serve() })
+	ch = make(chan core.AcceptResult, 1)
+	select {
+	case r := <-self.results:
+		ch <- r
+	case <-self.done:
+		close(ch)
+	}
 	return
 }
 
 func NewWrapBE(raddr string, pb core.PortBuilder) *WrapBE {
-	return &WrapBE{raddr, pb}
+	return NewWrapBEWithDialer(raddr, pb, &net.Dialer{})
+}
+
+func NewWrapBEWithDialer(raddr string, pb core.PortBuilder, dialer core.Dialer) *WrapBE {
+	return &WrapBE{raddr: raddr, pb: pb, dialer: dialer}
 }
 
 type WrapBE struct {
-	raddr string
-	pb    core.PortBuilder
+	raddr  string
+	pb     core.PortBuilder
+	dialer core.Dialer
+	// If not nil, chaff is sent to peers speaking wrap.CHAFF_VERSION.
+	Chaff *core.ChaffConfig
+	// If set, streams are multiplexed over one connection to peers speaking
+	// wrap.MUX_VERSION, so they don't wait for handshakes.
+	Mux bool
+	mu  sync.Mutex
+	mux *core.Mux
+	// The protocol version agreed on the multiplexed connection.
+	muxVersion int
+	// The multiplexed connection being dialed, shared by streams opened
+	// meanwhile.
+	muxDial *muxDial
+	// Set once the peer declined to multiplex, then streams are dialed as
+	// plain connections.
+	declined bool
+	pool     *connPool
 }
 
-func (self *WrapBE) handshake(c net.Conn, addr string) (p core.Port, err error) {
-	var b core.IoVec
-	enc := gob.NewEncoder(&b)
-	req := wrap.TCPRequest{addr}
-	err = enc.Encode(&req)
+// Peers multiplexing streams below wrap.MUX_VERSION open them differently.
+var errMuxVersion = errors.New("Multiplexing by an older protocol version is not supported")
+
+type muxDial struct {
+	done    chan struct{}
+	m       *core.Mux
+	version int
+	err     error
+}
+
+// Returns the protocol version agreed with the peer and whether streams are
+// multiplexed.
+func (self *WrapBE) exchangeKeys(p SessionPort, mux bool) (int, bool, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return 0, false, core.Tr(err)
+	}
+	rpc := &core.GobRPC{P: p}
+	hello := wrap.Hello{
+		Version:   wrap.VERSION,
+		PublicKey: priv.PublicKey().Bytes(),
+		Time:      time.Now().Unix(),
+		Pipelines: p.Pipelines(),
+		Morph:     p.Morph(),
+		Mux:       mux,
+	}
+	var reply wrap.HelloReply
+	if err := rpc.Request(&hello, &reply); err != nil {
+		return 0, false, core.Tr(err)
+	}
+	if reply.Error != "" {
+		return 0, false, core.Tr(fmt.Errorf("%s rejected hello: %s", self.raddr, reply.Error))
+	}
+	if reply.Version < wrap.MIN_VERSION || reply.Version > wrap.VERSION {
+		return 0, false, core.Tr(fmt.Errorf("Protocol version %d is not supported, expecting %d to %d", reply.Version, wrap.MIN_VERSION, wrap.VERSION))
+	}
+	if mux && reply.Mux && reply.Version < wrap.MUX_VERSION {
+		return 0, false, core.Tr(fmt.Errorf("%s multiplexes streams by protocol version %d: %w", self.raddr, reply.Version, errMuxVersion))
+	}
+	packKey, unpackKey, err := deriveSessionKeys(priv, reply.PublicKey, true)
+	if err != nil {
+		return 0, false, core.Tr(err)
+	}
+	return reply.Version, mux && reply.Mux, core.Tr(p.SetSession(reply.Pipeline, packKey, unpackKey))
+}
+
+// If mux is set and the peer agrees, a Mux is returned instead of the port
+// serving req.
+func (self *WrapBE) handshake(c net.Conn, req *wrap.TCPRequest, mux bool) (p core.Port, version int, m *core.Mux, err error) {
+	p, version, m, err = self.session(c, mux)
+	if err != nil || m != nil {
+		return
+	}
+	err = self.request(p, req)
+	return
+}
+
+func (self *WrapBE) request(p core.Port, req *wrap.TCPRequest) error {
+	b, err := encodeRequest(req)
+	if err != nil {
+		return err
+	}
+	return core.Tr(p.Pack(b))
+}
+
+// Establishes the session, i.e., everything before the request.
+func (self *WrapBE) session(c net.Conn, mux bool) (p core.Port, version int, m *core.Mux, err error) {
+	sp, err := asSessionPort(self.pb.FromConn(c))
 	if err != nil {
 		err = core.Tr(err)
 		return
 	}
-	p = self.pb.FromConn(c)
-	err = p.Pack(&b)
+	p = sp
+	var muxed bool
+	version, muxed, err = self.exchangeKeys(sp, mux)
 	if err != nil {
 		err = core.Tr(err)
 		return
 	}
+	if version >= wrap.CHAFF_VERSION {
+		p = newChaffPort(sp, self.Chaff, version)
+	}
+	if muxed {
+		m = core.NewMux(p, true)
+	}
 	return
 }
 
-func (self *WrapBE) Dial(addr string) (ch chan core.DialResult) {
+// EnablePool keeps connections warm, whose sessions are established before
+// being dialed. It's not used by multiplexed streams.
+func (self *WrapBE) EnablePool(config PoolConfig) {
+	self.pool = newConnPool(config, self.raddr, self.warm)
+}
+
+func (self *WrapBE) warm() (*warmConn, error) {
+	c, err := self.dialer.Dial("tcp", self.raddr)
+	if err != nil {
+		return nil, err
+	}
+	pc := newProbeConn(c)
+	p, version, _, err := self.session(pc, false)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &warmConn{c: pc, p: p, version: version, since: time.Now()}, nil
+}
+
+func (self *WrapBE) PoolStats() PoolStats {
+	if self.pool == nil {
+		return PoolStats{}
+	}
+	return self.pool.stats()
+}
+
+// Close closes the pool and the multiplexed connection.
+func (self *WrapBE) Close() error {
+	if self.pool != nil {
+		self.pool.Close()
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.mux != nil {
+		return self.mux.Close()
+	}
+	return nil
+}
+
+func (self *WrapBE) dial(req *wrap.TCPRequest, mux bool) (core.Port, int, *core.Mux, error) {
+	if !mux && self.pool != nil {
+		if w := self.pool.get(); w != nil {
+			log.Println("Relaying to", req.Network, req.Addr, "at", w.c.LocalAddr())
+			err := self.request(w.p, req)
+			if err == nil {
+				return w.p, w.version, nil, nil
+			}
+			// Fall back to a new connection.
+			log.Println(err)
+			w.p.Close()
+		}
+	}
+	c, err := self.dialer.Dial("tcp", self.raddr)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	log.Println("Relaying to", req.Network, req.Addr, "at", c.LocalAddr())
+	p, version, m, err := self.handshake(c, req, mux)
+	if err != nil {
+		c.Close()
+		return nil, 0, nil, err
+	}
+	return p, version, m, nil
+}
+
+// Streams are opened on the shared connection, which is established on
+// demand. If the peer doesn't multiplex, the connection serves req alone and
+// later streams are dialed as plain connections.
+func (self *WrapBE) open(req *wrap.TCPRequest) (core.Port, int, error) {
+	self.mu.Lock()
+	if self.declined {
+		self.mu.Unlock()
+		p, version, _, err := self.dial(req, false)
+		return p, version, err
+	}
+	if m := self.mux; m != nil && m.Err() == nil {
+		version := self.muxVersion
+		self.mu.Unlock()
+		return self.openStream(m, version, req)
+	}
+	if d := self.muxDial; d != nil {
+		self.mu.Unlock()
+		<-d.done
+		if d.err != nil {
+			return nil, 0, d.err
+		}
+		if d.m == nil {
+			p, version, _, err := self.dial(req, false)
+			return p, version, err
+		}
+		return self.openStream(d.m, d.version, req)
+	}
+	d := &muxDial{done: make(chan struct{})}
+	self.muxDial = d
+	self.mu.Unlock()
+	p, version, m, err := self.dial(req, true)
+	if errors.Is(err, errMuxVersion) {
+		// Such peers open streams by bare addresses, so they are treated as
+		// declining.
+		log.Println(err)
+		p, version, m, err = self.dial(req, false)
+	}
+	self.mu.Lock()
+	self.muxDial = nil
+	if err == nil {
+		if m == nil {
+			log.Println(self.raddr, "declined to multiplex streams")
+			self.declined = true
+		} else {
+			self.mux, self.muxVersion = m, version
+		}
+	}
+	self.mu.Unlock()
+	d.m, d.version, d.err = m, version, err
+	close(d.done)
+	if err != nil || m == nil {
+		return p, version, err
+	}
+	return self.openStream(m, version, req)
+}
+
+func (self *WrapBE) openStream(m *core.Mux, version int, req *wrap.TCPRequest) (core.Port, int, error) {
+	hdr, err := encodeRequest(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	s, err := m.Open(hdr.Consume())
+	return s, version, err
+}
+
+// Reads the response of peers speaking wrap.RESPONSE_VERSION. p is closed if
+// the peer failed to dial.
+func (self *WrapBE) response(p core.Port, req *wrap.TCPRequest) (core.Port, net.Addr, error) {
+	resp, rp, err := readResponse(p)
+	if err != nil {
+		p.Close()
+		return nil, nil, err
+	}
+	if resp.Status != wrap.STATUS_OK {
+		p.Close()
+		class := resp.Class
+		if resp.Status == wrap.STATUS_BAD_REQUEST {
+			class = core.DIAL_ERROR_UNSUPPORTED_NETWORK
+		}
+		return nil, nil, &core.DialError{Addr: req.Addr, Class: class, Err: errors.New(resp.Error)}
+	}
+	var bound net.Addr
+	if resp.Bound != "" {
+		ap, err := netip.ParseAddrPort(resp.Bound)
+		if err != nil {
+			p.Close()
+			return nil, nil, core.Tr(err)
+		}
+		bound = net.TCPAddrFromAddrPort(ap)
+	}
+	return rp, bound, nil
+}
+
+func (self *WrapBE) Dial(network, addr string) (ch chan core.DialResult) {
 	ch = make(chan core.DialResult)
 	go func() {
-		c, err := net.Dial("tcp", self.raddr)
+		req := &wrap.TCPRequest{Addr: addr, Network: network}
+		var p core.Port
+		var version int
+		var err error
+		if self.Mux {
+			p, version, err = self.open(req)
+		} else {
+			p, version, _, err = self.dial(req, false)
+		}
 		if err != nil {
-			log.Println(err)
-			close(ch)
+			ch <- core.DialResult{Err: err}
 			return
 		}
-		log.Println("Relaying to", addr, "at", c.LocalAddr())
-		p, err := self.handshake(c, addr)
+		if version < wrap.RESPONSE_VERSION {
+			ch <- core.DialResult{Port: p}
+			return
+		}
+		p, bound, err := self.response(p, req)
 		if err != nil {
-			log.Println(err)
-			close(ch)
-			c.Close()
+			ch <- core.DialResult{Err: err}
 			return
 		}
-		ch <- core.DialResult{p}
+		ch <- core.DialResult{Port: p, Bound: bound}
 	}()
 	return
 }
@@ -0,0 +1,515 @@
+package relayer
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bzEq/bxrx/core"
+	"github.com/bzEq/bxrx/pass"
+	h1p "github.com/bzEq/bxrx/proxy/http"
+	"github.com/bzEq/bxrx/proxy/socks5"
+	"github.com/bzEq/bxrx/proxy/wrap"
+)
+
+var frameSpec = pass.MustParseSpec("random(pad|obfs, obfs)>frame", CARRIERS...)
+var wsSpec = pass.MustParseSpec("obfs|pad>websocket", CARRIERS...)
+var chunkedSpec = pass.MustParseSpec("random(pad|obfs, obfs)>chunked", CARRIERS...)
+
+func testWrapHandshake(t *testing.T, fpb, bpb core.PortBuilder) {
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+	testWrapHandshakeOverConn(t, c0, c1, fpb, bpb)
+}
+
+func testWrapHandshakeOverConn(t *testing.T, c0, c1 net.Conn, fpb, bpb core.PortBuilder) {
+	testWrap(t, c0, c1, NewWrapFE(nil, fpb), &WrapBE{pb: bpb})
+}
+
+func testWrap(t *testing.T, c0, c1 net.Conn, fe *WrapFE, be *WrapBE) {
+	done := make(chan core.Port)
+	go func() {
+		p, _, req, _, err := fe.handshake(c1)
+		if err != nil {
+			t.Error(err)
+			close(done)
+			return
+		}
+		if req.Addr != "example.com:80" {
+			t.Error(req.Addr)
+		}
+		done <- p
+	}()
+	p, _, _, err := be.handshake(c0, &wrap.TCPRequest{Addr: "example.com:80"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, ok := <-done
+	if !ok {
+		t.FailNow()
+	}
+	go p.Pack(core.FromSlice([]byte("hello")))
+	var b core.IoVec
+	if err := q.Unpack(&b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b.Consume()) != "hello" {
+		t.Fail()
+	}
+}
+
+func TestWrapHandshake(t *testing.T) {
+	testWrapHandshake(t, &Pipeline{}, &Pipeline{})
+}
+
+func TestWrapHandshakeWithKey(t *testing.T) {
+	aead, err := pass.NewAEAD(pass.KeyFromPassphrase("wtf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testWrapHandshake(t, &Pipeline{AEAD: aead}, &Pipeline{AEAD: aead})
+}
+
+func TestWrapHandshakeFrameCarrier(t *testing.T) {
+	testWrapHandshake(t, &Pipeline{Specs: []*pass.Spec{frameSpec}}, &Pipeline{Specs: []*pass.Spec{frameSpec}})
+}
+
+func TestWrapHandshakeWebSocketCarrier(t *testing.T) {
+	testWrapHandshake(t, &Pipeline{Specs: []*pass.Spec{wsSpec}, Server: true}, &Pipeline{Specs: []*pass.Spec{wsSpec}})
+}
+
+func TestWrapHandshakeChunkedCarrier(t *testing.T) {
+	aead, err := pass.NewAEAD(pass.KeyFromPassphrase("wtf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testWrapHandshake(t, &Pipeline{Specs: []*pass.Spec{chunkedSpec}, AEAD: aead}, &Pipeline{Specs: []*pass.Spec{chunkedSpec}, AEAD: aead})
+}
+
+func TestWrapHandshakeOverHTTPTunnel(t *testing.T) {
+	ts := h1p.NewTunnelServer(nil)
+	server := httptest.NewServer(ts)
+	defer server.Close()
+	tc := &h1p.TunnelClient{Client: &http.Client{}, Path: "/"}
+	c0, err := tc.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c0.Close()
+	c1, err := ts.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	testWrapHandshakeOverConn(t, c0, c1, &Pipeline{Specs: []*pass.Spec{frameSpec}}, &Pipeline{Specs: []*pass.Spec{frameSpec}})
+}
+
+func createTLSPortBuilders(t *testing.T, pin string, mutual bool) (fpb, bpb core.PortBuilder) {
+	dir := t.TempDir()
+	serverCert, err := core.LoadOrCreateCertificate(filepath.Join(dir, "s.crt"), filepath.Join(dir, "s.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := core.LoadOrCreateCertificate(filepath.Join(dir, "c.crt"), filepath.Join(dir, "c.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCA := ""
+	if mutual {
+		clientCA = filepath.Join(dir, "c.crt")
+	}
+	serverConfig, err := core.CreateTLSServerConfig(serverCert, clientCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pin == "" {
+		pin = core.CertificateFingerprint(serverCert.Certificate[0])
+	}
+	clientConfig := core.CreateTLSClientConfig("", &clientCert, pin)
+	fpb = &TLSPortBuilder{Config: serverConfig, Server: true, Next: &Pipeline{}}
+	bpb = &TLSPortBuilder{Config: clientConfig, Next: &Pipeline{}}
+	return
+}
+
+func TestWrapHandshakeOverTLS(t *testing.T) {
+	fpb, bpb := createTLSPortBuilders(t, "", true)
+	testWrapHandshake(t, fpb, bpb)
+}
+
+func TestWrapHandshakeOverTLSWrongPin(t *testing.T) {
+	fpb, bpb := createTLSPortBuilders(t, strings.Repeat("0", 64), false)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c0, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c0.Close()
+	c1, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	go NewWrapFE(nil, fpb).handshake(c1)
+	be := &WrapBE{pb: bpb}
+	if _, _, _, err := be.handshake(c0, &wrap.TCPRequest{Addr: "example.com:80"}, false); err == nil {
+		t.Fail()
+	}
+}
+
+func TestWrapHandshakeNegotiation(t *testing.T) {
+	specs, err := ParsePipelineSpecs("obfs>frame; pad|obfs>frame; random(obfs, pad)>frame")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fpb := &Pipeline{Specs: specs[1:]}
+	bpb := &Pipeline{Specs: specs[:2]}
+	testWrapHandshake(t, fpb, bpb)
+	hello := &wrap.Hello{Version: wrap.VERSION, Pipelines: bpb.FromConn(nil).(SessionPort).Pipelines()}
+	_, pipeline, err := negotiate(hello, fpb.FromConn(nil).(SessionPort).Pipelines())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pipeline != "pad|obfs>frame" {
+		t.Fatal(pipeline)
+	}
+}
+
+func TestWrapHandshakeMorphMismatch(t *testing.T) {
+	d, err := pass.ParseSizeDistribution(strings.NewReader("128\n1400 4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+	go NewWrapFE(nil, &Pipeline{Specs: []*pass.Spec{frameSpec}, Morph: d, MorphOverhead: DEFAULT_MORPH_OVERHEAD}).handshake(c1)
+	be := &WrapBE{pb: &Pipeline{Specs: []*pass.Spec{frameSpec}}}
+	_, _, _, err = be.handshake(c0, &wrap.TCPRequest{Addr: "example.com:80"}, false)
+	if err == nil || !strings.Contains(err.Error(), "Morphing mismatches") {
+		t.Fatal(err)
+	}
+}
+
+func TestWrapHandshakeMismatch(t *testing.T) {
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+	fe := NewWrapFE(nil, &Pipeline{Specs: []*pass.Spec{frameSpec}})
+	be := &WrapBE{pb: &Pipeline{Specs: []*pass.Spec{pass.MustParseSpec("obfs>frame", CARRIERS...)}}}
+	go fe.handshake(c1)
+	_, _, _, err := be.handshake(c0, &wrap.TCPRequest{Addr: "example.com:80"}, false)
+	if err == nil || !strings.Contains(err.Error(), "No common pipeline") {
+		t.Fatal(err)
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	hello := &wrap.Hello{Version: wrap.MIN_VERSION - 1, Pipelines: []string{"obfs>frame"}}
+	if _, _, err := negotiate(hello, hello.Pipelines); err == nil {
+		t.Fail()
+	}
+	hello.Version = wrap.VERSION + 1
+	version, _, err := negotiate(hello, hello.Pipelines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != wrap.VERSION {
+		t.Fatal(version)
+	}
+}
+
+func TestParsePipelineSpecsCarrierMismatch(t *testing.T) {
+	if _, err := ParsePipelineSpecs("obfs>frame; obfs>websocket"); err == nil {
+		t.Fail()
+	}
+}
+
+func TestWrapHandshakeMorph(t *testing.T) {
+	d, err := pass.ParseSizeDistribution(strings.NewReader("128\n1400 4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fpb := &Pipeline{Specs: []*pass.Spec{frameSpec}, Morph: d, MorphOverhead: DEFAULT_MORPH_OVERHEAD}
+	bpb := &Pipeline{Specs: []*pass.Spec{frameSpec}, Morph: d, MorphOverhead: DEFAULT_MORPH_OVERHEAD}
+	testWrapHandshake(t, fpb, bpb)
+}
+
+func TestWrapHandshakeChaff(t *testing.T) {
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+	config := &core.ChaffConfig{
+		Model:    core.CHAFF_POISSON,
+		Interval: time.Millisecond,
+		MaxSize:  64,
+		Budget:   1 << 20,
+	}
+	fe := NewWrapFE(nil, &Pipeline{Specs: []*pass.Spec{frameSpec}})
+	fe.Chaff = config
+	be := &WrapBE{pb: &Pipeline{Specs: []*pass.Spec{frameSpec}}, Chaff: config}
+	testWrap(t, c0, c1, fe, be)
+}
+
+// Counts accepted connections.
+type countingListener struct {
+	net.Listener
+	n int32
+}
+
+func (self *countingListener) Accept() (net.Conn, error) {
+	c, err := self.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&self.n, 1)
+	}
+	return c, err
+}
+
+func TestWrapMux(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := &countingListener{Listener: l}
+	defer ln.Close()
+	fe := NewWrapFE(ln, &Pipeline{Specs: []*pass.Spec{frameSpec}})
+	be := NewWrapBE(ln.Addr().String(), &Pipeline{Specs: []*pass.Spec{frameSpec}})
+	be.Mux = true
+	for _, addr := range []string{"example.com:80", "example.com:443", "example.org:80"} {
+		accepted := make(chan core.AcceptResult, 1)
+		go func() {
+			if ar, ok := <-fe.Accept(); ok {
+				ar.Reply(nil, nil)
+				accepted <- ar
+			}
+			close(accepted)
+		}()
+		dr, ok := <-be.Dial(core.NETWORK_TCP, addr)
+		if !ok || dr.Err != nil {
+			t.Fatal("Dialing", addr, "failed", dr.Err)
+		}
+		ar, ok := <-accepted
+		if !ok {
+			t.Fatal("Accepting", addr, "failed")
+		}
+		if ar.Addr != addr {
+			t.Fatal(ar.Addr)
+		}
+		go dr.Port.Pack(core.FromSlice([]byte(addr)))
+		var b core.IoVec
+		if err := ar.Port.Unpack(&b); err != nil {
+			t.Fatal(err)
+		}
+		if string(b.Consume()) != addr {
+			t.Fail()
+		}
+		dr.Port.Close()
+		ar.Port.Close()
+	}
+	if n := atomic.LoadInt32(&ln.n); n != 1 {
+		t.Fatal(n, "connections are accepted")
+	}
+}
+
+func testWrapDialResponse(t *testing.T, mux bool) {
+	wln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wln.Close()
+	fe := NewWrapFE(wln, &Pipeline{Specs: []*pass.Spec{frameSpec}})
+	go func() {
+		for {
+			ar, ok := <-fe.Accept()
+			if !ok {
+				return
+			}
+			go core.NewRelayer(fe, &TCPBE{}).Handle(ar)
+		}
+	}()
+	be := NewWrapBE(wln.Addr().String(), &Pipeline{Specs: []*pass.Spec{frameSpec}})
+	be.Mux = mux
+	defer be.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	dr := <-be.Dial(core.NETWORK_TCP, closed.Addr().String())
+	var de *core.DialError
+	if !errors.As(dr.Err, &de) || de.Class != core.DIAL_ERROR_REFUSED {
+		t.Fatal(dr.Err)
+	}
+	if r := socks5.ReplyOfDialError(dr.Err); r != socks5.REP_CONNECTION_REFUSED {
+		t.Fatal(r)
+	}
+	dr = <-be.Dial("sctp", closed.Addr().String())
+	if !errors.As(dr.Err, &de) || de.Class != core.DIAL_ERROR_UNSUPPORTED_NETWORK {
+		t.Fatal(dr.Err)
+	}
+	if r := socks5.ReplyOfDialError(dr.Err); r != socks5.REP_COMMAND_NOT_SUPPORTED {
+		t.Fatal(r)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dr = <-be.Dial(core.NETWORK_TCP, ln.Addr().String())
+	if dr.Err != nil {
+		t.Fatal(dr.Err)
+	}
+	defer dr.Port.Close()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if bound, ok := dr.Bound.(*net.TCPAddr); !ok || bound.String() != c.RemoteAddr().String() {
+		t.Fatal(dr.Bound)
+	}
+	go dr.Port.Pack(core.FromSlice([]byte("ping")))
+	buf := make([]byte, 4)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatal(err, string(buf))
+	}
+}
+
+func TestWrapDialResponse(t *testing.T) {
+	testWrapDialResponse(t, false)
+}
+
+func TestWrapDialResponseMux(t *testing.T) {
+	testWrapDialResponse(t, true)
+}
+
+func TestReadResponse(t *testing.T) {
+	var rec framesPort
+	if err := writeResponse(&rec, &wrap.TCPResponse{Status: wrap.STATUS_OK, Bound: "127.0.0.1:80"}); err != nil {
+		t.Fatal(err)
+	}
+	// The response is followed by bytes of the stream, and frames don't keep
+	// its boundary.
+	stream := append(rec.frames[0], "tail"...)
+	var p framesPort
+	for len(stream) > 3 {
+		p.frames = append(p.frames, stream[:3])
+		stream = stream[3:]
+	}
+	p.frames = append(p.frames, stream)
+	resp, rp, err := readResponse(&p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != wrap.STATUS_OK || resp.Bound != "127.0.0.1:80" {
+		t.Fatal(resp)
+	}
+	var tail []byte
+	for {
+		var b core.IoVec
+		if err := rp.Unpack(&b); err != nil {
+			break
+		}
+		tail = append(tail, b.Consume()...)
+	}
+	if string(tail) != "tail" {
+		t.Fatal(string(tail))
+	}
+}
+
+// Frames packed are appended, and unpacked in order.
+type framesPort struct {
+	net.Conn
+	frames [][]byte
+}
+
+func (self *framesPort) Pack(b *core.IoVec) error {
+	self.frames = append(self.frames, b.Consume())
+	return nil
+}
+
+func (self *framesPort) Unpack(b *core.IoVec) error {
+	if len(self.frames) == 0 {
+		return io.EOF
+	}
+	b.Take(self.frames[0])
+	self.frames = self.frames[1:]
+	return nil
+}
+
+func (self *framesPort) CloseRead() error {
+	return nil
+}
+
+func (self *framesPort) CloseWrite() error {
+	return nil
+}
+
+func TestWrapMuxDeclined(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := &countingListener{Listener: l}
+	defer ln.Close()
+	fe := NewWrapFE(ln, &Pipeline{Specs: []*pass.Spec{frameSpec}})
+	fe.version = wrap.MUX_VERSION - 1
+	go func() {
+		for {
+			ar, ok := <-fe.Accept()
+			if !ok {
+				return
+			}
+			go func() {
+				defer ar.Port.Close()
+				var b core.IoVec
+				if err := ar.Port.Unpack(&b); err == nil {
+					ar.Port.Pack(&b)
+				}
+			}()
+		}
+	}()
+	be := NewWrapBE(ln.Addr().String(), &Pipeline{Specs: []*pass.Spec{frameSpec}})
+	be.Mux = true
+	defer be.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dr := <-be.Dial(core.NETWORK_TCP, "example.com:80")
+			if dr.Err != nil {
+				t.Error(dr.Err)
+				return
+			}
+			defer dr.Port.Close()
+			dr.Port.Pack(core.FromSlice([]byte("ping")))
+			var b core.IoVec
+			if err := dr.Port.Unpack(&b); err != nil || string(b.Consume()) != "ping" {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	if !be.declined || be.mux != nil {
+		t.Fatal("Declined multiplexing isn't remembered")
+	}
+	if n := atomic.LoadInt32(&ln.n); n != 4 {
+		t.Fatal(n, "connections are accepted")
+	}
+}